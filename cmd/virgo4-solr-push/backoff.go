@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+)
+
+// tracks consecutive failures of an operation and how long to wait before trying it again. The delay doubles
+// with each failure up to the maximum
+type backoff struct {
+	base     time.Duration // the delay after the first failure
+	max      time.Duration // the maximum delay
+	failures int           // the number of consecutive failures
+	retryAt  time.Time     // when we can try again
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// record a failure and return how long to wait before trying again
+func (b *backoff) failed() time.Duration {
+
+	b.failures++
+
+	delay := b.base
+	for i := 1; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+
+	b.retryAt = time.Now().Add(delay)
+	return delay
+}
+
+// record a success
+func (b *backoff) succeeded() {
+	b.failures = 0
+	b.retryAt = time.Time{}
+}
+
+// are we waiting before trying again
+func (b *backoff) waiting() bool {
+	return time.Now().Before(b.retryAt)
+}
+
+// how long until we can try again
+func (b *backoff) remaining() time.Duration {
+	return time.Until(b.retryAt)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the weight given to the newest observation when smoothing the latency and error rate
+var sizerSmoothing = 0.2
+
+// the smoothed error rate above which we send smaller batches
+var sizerErrorRate = 0.1
+
+// the inbound queue is nearly empty when it holds less than this fraction of its capacity
+var quietQueueFraction = 0.1
+
+// the batch sizing for a single destination, shared by all the workers. With adaptive batching, the block
+// count grows while SOLR adds full batches quickly and shrinks when adds are slow or failing, staying within
+// the configured bounds. We also flush sooner when the inbound queue is nearly empty so that single updates
+// become visible quickly. Otherwise the configured values are used
+type batchSizer struct {
+	sync.Mutex
+	name       string            // the destination name
+	adaptive   bool              // is adaptive batching enabled
+	minCount   uint              // the smallest block count
+	maxCount   uint              // the largest block count
+	count      uint              // the current block count
+	target     time.Duration     // the add latency we aim for
+	flush      time.Duration     // the configured flush time
+	quietFlush time.Duration     // the flush time when the inbound queue is nearly empty
+	latency    time.Duration     // the smoothed add latency
+	errorRate  float64           // the smoothed add error rate, we do not grow while it is high
+	inbound    func() (int, int) // the number of messages in the inbound queue and its capacity
+}
+
+// the batch sizers for each destination
+var batchSizers = make(map[string]*batchSizer)
+
+// create the batch sizers for each destination
+func createBatchSizers(config *ServiceConfig, inbound chan awssqs.Message) {
+
+	queue := func() (int, int) {
+		return len(inbound), cap(inbound)
+	}
+
+	for _, dc := range config.Destinations {
+		batchSizers[dc.Name] = newBatchSizer(config.ForDestination(dc), queue)
+	}
+}
+
+// get the batch sizer for a destination
+func batchSizerFor(config ServiceConfig) *batchSizer {
+
+	b, found := batchSizers[config.DestinationName]
+	if found == false {
+		// not created up front (so not shared), just make one
+		b = newBatchSizer(config, nil)
+	}
+	return b
+}
+
+func newBatchSizer(config ServiceConfig, inbound func() (int, int)) *batchSizer {
+
+	b := &batchSizer{
+		name:       config.DestinationName,
+		adaptive:   config.AdaptiveBatching,
+		minCount:   config.SolrMinBlockCount,
+		maxCount:   config.SolrBlockCount,
+		count:      config.SolrBlockCount,
+		target:     time.Duration(config.AdaptiveTargetLatency) * time.Millisecond,
+		flush:      time.Duration(config.SolrFlushTime) * time.Second,
+		quietFlush: time.Duration(config.SolrQuietFlushTime) * time.Millisecond,
+		inbound:    inbound,
+	}
+
+	if b.minCount < 1 {
+		b.minCount = 1
+	}
+	if b.minCount > b.maxCount {
+		b.minCount = b.maxCount
+	}
+
+	blockCount.WithLabelValues(b.name).Set(float64(b.count))
+	return b
+}
+
+// the block count to use
+func (b *batchSizer) blockCount() uint {
+	b.Lock()
+	defer b.Unlock()
+	return b.count
+}
+
+// the flush time to use
+func (b *batchSizer) flushTime() time.Duration {
+
+	if b.adaptive == false || b.inbound == nil || b.quietFlush >= b.flush {
+		return b.flush
+	}
+
+	queued, capacity := b.inbound()
+	if float64(queued) <= quietQueueFraction*float64(capacity) {
+		return b.quietFlush
+	}
+	return b.flush
+}
+
+// observe the outcome of adding a batch. Failures are those that say nothing about the documents themselves,
+// timeouts and server errors
+func (b *batchSizer) observe(documents uint, latency time.Duration, failed bool) {
+
+	if b.adaptive == false {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency = time.Duration((1-sizerSmoothing)*float64(b.latency) + sizerSmoothing*float64(latency))
+	}
+
+	failure := 0.0
+	if failed == true {
+		failure = 1.0
+	}
+	b.errorRate = (1-sizerSmoothing)*b.errorRate + sizerSmoothing*failure
+
+	// the latency of this batch tells us which way to go, failures halve the block count while the error
+	// rate is high
+	count := b.count
+	switch {
+	case failed == true:
+		if b.errorRate > sizerErrorRate {
+			count = count / 2
+		}
+	case latency > b.target:
+		count = count * 3 / 4
+	// only a full batch tells us whether a larger one would be quick enough
+	case latency < b.target/2 && documents >= b.count && b.errorRate <= sizerErrorRate:
+		count += max(1, count/4)
+	}
+	count = min(max(count, b.minCount), b.maxCount)
+
+	if count != b.count {
+		log.Printf("INFO: %s block count changed from %d to %d (latency %s, error rate %0.2f)", b.name, b.count, count,
+			b.latency.Round(time.Millisecond), b.errorRate)
+		b.count = count
+		blockCount.WithLabelValues(b.name).Set(float64(b.count))
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// an adaptive batch sizer with a block count between 10 and 100 aiming for one second adds
+func testBatchSizer(count uint, inbound func() (int, int)) *batchSizer {
+
+	config := testConfig()
+	config.AdaptiveBatching = true
+	config.SolrMinBlockCount = 10
+	config.SolrBlockCount = 100
+	config.AdaptiveTargetLatency = 1000
+	config.SolrFlushTime = 10
+	config.SolrQuietFlushTime = 250
+
+	b := newBatchSizer(config, inbound)
+	b.count = count
+	return b
+}
+
+func TestBatchSizerObserve(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		count     uint
+		errorRate float64
+		documents uint
+		latency   time.Duration
+		failed    bool
+		expected  uint
+	}{
+		{name: "fast full batch grows", count: 40, documents: 40, latency: 100 * time.Millisecond, expected: 50},
+		{name: "fast partial batch stays", count: 40, documents: 20, latency: 100 * time.Millisecond, expected: 40},
+		{name: "within target stays", count: 40, documents: 40, latency: 800 * time.Millisecond, expected: 40},
+		{name: "slow shrinks", count: 40, documents: 40, latency: 2 * time.Second, expected: 30},
+		{name: "failure shrinks", count: 40, documents: 40, latency: 100 * time.Millisecond, failed: true, expected: 20},
+		{name: "high error rate does not grow", count: 40, errorRate: 0.5, documents: 40, latency: 100 * time.Millisecond, expected: 40},
+		{name: "clamped to the maximum", count: 95, documents: 95, latency: 100 * time.Millisecond, expected: 100},
+		{name: "clamped to the minimum", count: 12, documents: 12, latency: 2 * time.Second, expected: 10},
+		{name: "failure clamped to the minimum", count: 12, documents: 12, failed: true, expected: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			b := testBatchSizer(test.count, nil)
+			b.errorRate = test.errorRate
+			b.observe(test.documents, test.latency, test.failed)
+			if b.blockCount() != test.expected {
+				t.Errorf("expected a block count of %d, got %d", test.expected, b.blockCount())
+			}
+		})
+	}
+}
+
+func TestBatchSizerNotAdaptive(t *testing.T) {
+
+	b := testBatchSizer(40, nil)
+	b.adaptive = false
+	b.observe(40, 10*time.Second, true)
+	if b.blockCount() != 40 {
+		t.Errorf("expected the block count to stay at 40, got %d", b.blockCount())
+	}
+}
+
+func TestBatchSizerRecovers(t *testing.T) {
+
+	// a run of slow adds shrinks the block count to the minimum, fast ones grow it back to the maximum
+	b := testBatchSizer(100, nil)
+	for i := 0; i < 20; i++ {
+		b.observe(b.blockCount(), 2*time.Second, false)
+	}
+	if b.blockCount() != 10 {
+		t.Errorf("expected the block count to shrink to 10, got %d", b.blockCount())
+	}
+	for i := 0; i < 40; i++ {
+		b.observe(b.blockCount(), 100*time.Millisecond, false)
+	}
+	if b.blockCount() != 100 {
+		t.Errorf("expected the block count to grow to 100, got %d", b.blockCount())
+	}
+}
+
+func TestBatchSizerFlushTime(t *testing.T) {
+
+	queue := func(queued int) func() (int, int) {
+		return func() (int, int) { return queued, 100 }
+	}
+
+	tests := []struct {
+		name     string
+		adaptive bool
+		inbound  func() (int, int)
+		expected time.Duration
+	}{
+		{name: "quiet queue", adaptive: true, inbound: queue(10), expected: 250 * time.Millisecond},
+		{name: "empty queue", adaptive: true, inbound: queue(0), expected: 250 * time.Millisecond},
+		{name: "busy queue", adaptive: true, inbound: queue(11), expected: 10 * time.Second},
+		{name: "no queue", adaptive: true, inbound: nil, expected: 10 * time.Second},
+		{name: "not adaptive", adaptive: false, inbound: queue(0), expected: 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			b := testBatchSizer(100, test.inbound)
+			b.adaptive = test.adaptive
+			if got := b.flushTime(); got != test.expected {
+				t.Errorf("expected a flush time of %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
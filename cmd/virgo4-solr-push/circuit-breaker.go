@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// the circuit breaker states
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // SOLR is available, everything flows
+	breakerOpen                         // SOLR is unavailable, we stop polling and flushing
+	breakerHalfOpen                     // we are probing SOLR to see if it is back
+)
+
+// a circuit breaker for a single SOLR destination, shared by all the workers. It is fed the results of the
+// SOLR requests and opens after too many consecutive failures. While it is open, we periodically probe SOLR
+// and close it again once SOLR answers
+type circuitBreaker struct {
+	sync.Mutex
+	name       string        // the destination name
+	threshold  int           // the number of consecutive failures that opens the breaker
+	probeTime  time.Duration // how often we probe SOLR while the breaker is open
+	state      breakerState  // the current state
+	failures   int           // the number of consecutive failures
+	probe      func() error  // how we probe SOLR
+	probing    bool          // is the probe running
+	lastChange time.Time     // when the state last changed
+}
+
+// the circuit breakers for each destination
+var circuitBreakers = make(map[string]*circuitBreaker)
+
+// create the circuit breakers for each destination. They start open so that we wait for
+// SOLR to answer before we start work
+func createCircuitBreakers(config *ServiceConfig) {
+
+	for _, dc := range config.Destinations {
+		b := newCircuitBreaker(dc.Name, config.BreakerThreshold, time.Duration(config.BreakerProbeTime)*time.Second)
+		b.setState(breakerOpen)
+		circuitBreakers[dc.Name] = b
+	}
+}
+
+// get the circuit breaker for the named destination
+func circuitBreakerFor(name string) *circuitBreaker {
+
+	b, found := circuitBreakers[name]
+	if found == false {
+		// not created up front (so not shared), just make one
+		b = newCircuitBreaker(name, 0, 0)
+	}
+	return b
+}
+
+// are any of the circuit breakers for the required destinations open
+func requiredBreakersOpen(config *ServiceConfig) bool {
+
+	for _, dc := range config.Destinations {
+		if dc.Required == true && circuitBreakerFor(dc.Name).isOpen() == true {
+			return true
+		}
+	}
+	return false
+}
+
+func newCircuitBreaker(name string, threshold int, probeTime time.Duration) *circuitBreaker {
+	b := &circuitBreaker{name: name, threshold: threshold, probeTime: probeTime, lastChange: time.Now()}
+	b.setState(breakerClosed)
+	return b
+}
+
+// set the function used to probe SOLR while the breaker is open
+func (b *circuitBreaker) setProbe(probe func() error) {
+	b.Lock()
+	defer b.Unlock()
+	b.probe = probe
+}
+
+// a SOLR request succeeded
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	if b.state != breakerClosed {
+		log.Printf("INFO: %s circuit breaker closed, SOLR is available after %0.2f seconds", b.name, time.Since(b.lastChange).Seconds())
+		b.setState(breakerClosed)
+	}
+}
+
+// a SOLR request failed
+func (b *circuitBreaker) failure(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+
+	// a threshold of zero means the breaker is disabled
+	if b.threshold == 0 {
+		return
+	}
+
+	if (b.state == breakerClosed && b.failures >= b.threshold) || b.state == breakerHalfOpen {
+		if b.state == breakerClosed {
+			log.Printf("WARNING: %s circuit breaker opened after %d consecutive failures (%s)", b.name, b.failures, err.Error())
+		}
+		b.setState(breakerOpen)
+	}
+
+	// make sure we are probing
+	if b.state == breakerOpen && b.probing == false {
+		b.probing = true
+		go b.probeLoop()
+	}
+}
+
+// is the breaker open (or half open)
+func (b *circuitBreaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state != breakerClosed
+}
+
+// periodically probe SOLR until the breaker closes. The probe result is reported by the probe itself
+func (b *circuitBreaker) probeLoop() {
+
+	for {
+		time.Sleep(b.probeTime)
+
+		b.Lock()
+		if b.state == breakerClosed {
+			b.probing = false
+			b.Unlock()
+			return
+		}
+		b.setState(breakerHalfOpen)
+		probe := b.probe
+		b.Unlock()
+
+		log.Printf("INFO: %s circuit breaker half open, probing SOLR", b.name)
+		if probe == nil {
+			// nobody has connected yet, they will report the result
+			continue
+		}
+
+		err := probe()
+		if err != nil {
+			log.Printf("WARNING: %s SOLR probe failed (%s)", b.name, err.Error())
+		}
+	}
+}
+
+// change the state, the caller must hold the lock
+func (b *circuitBreaker) setState(state breakerState) {
+
+	if state != b.state {
+		b.lastChange = time.Now()
+	}
+	b.state = state
+
+	open := 0.0
+	if state != breakerClosed {
+		open = 1.0
+	}
+	circuitOpen.WithLabelValues(b.name).Set(open)
+}
+
+//
+// end of file
+//
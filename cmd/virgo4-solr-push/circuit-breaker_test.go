@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a shared circuit breaker for the named destination that probes quickly, removed when the test is done
+func testBreaker(t *testing.T, name string, threshold int) *circuitBreaker {
+
+	b := newCircuitBreaker(name, threshold, 10*time.Millisecond)
+	circuitBreakers[name] = b
+	t.Cleanup(func() {
+		b.success()
+		delete(circuitBreakers, name)
+	})
+	return b
+}
+
+// wait for the condition, failing if it does not happen in time
+func waitFor(t *testing.T, what string, condition func() bool) {
+
+	for deadline := time.Now().Add(5 * time.Second); condition() == false; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) == true {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+
+	b := testBreaker(t, "breaker", 3)
+	failure := errors.New("connection refused")
+
+	// SOLR answers again on the second probe
+	var probes atomic.Int32
+	b.setProbe(func() error {
+		if probes.Add(1) < 2 {
+			b.failure(failure)
+			return failure
+		}
+		b.success()
+		return nil
+	})
+
+	// opens after the threshold and not before
+	b.failure(failure)
+	b.failure(failure)
+	if b.isOpen() == true {
+		t.Fatalf("expected the breaker to be closed below the threshold")
+	}
+	b.success()
+	b.failure(failure)
+	b.failure(failure)
+	if b.isOpen() == true {
+		t.Fatalf("expected a success to reset the failure count")
+	}
+	b.failure(failure)
+	if b.isOpen() == false {
+		t.Fatalf("expected the breaker to open at the threshold")
+	}
+
+	// the probe closes it once SOLR answers
+	waitFor(t, "the breaker to close", func() bool { return b.isOpen() == false })
+	if probes.Load() != 2 {
+		t.Errorf("expected 2 probes, got %d", probes.Load())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+
+	b := testBreaker(t, "disabled", 0)
+	for i := 0; i < 10; i++ {
+		b.failure(errors.New("connection refused"))
+	}
+	if b.isOpen() == true {
+		t.Errorf("expected a breaker without a threshold to stay closed")
+	}
+}
+
+func TestReadinessWhileBreakerOpen(t *testing.T) {
+
+	b := testBreaker(t, "readiness", 1)
+	h := &healthTracker{livenessWindow: time.Minute, workers: make(map[int]*workerHealth)}
+	h.received(nil)
+	h.pinged(1, "readiness", true, nil)
+	if h.ready().Healthy == false {
+		t.Fatalf("expected the service to be ready")
+	}
+
+	// the last ping succeeded but SOLR has failed since
+	b.failure(errors.New("connection refused"))
+	report := h.ready()
+	if report.Healthy == true || report.Workers[0].Destinations["readiness"].Alive == true {
+		t.Errorf("expected the service not to be ready while the breaker is open, got %+v", report.Workers[0].Destinations["readiness"])
+	}
+
+	b.success()
+	if h.ready().Healthy == false {
+		t.Errorf("expected the service to be ready once the breaker closes")
+	}
+}
+
+//
+// end of file
+//
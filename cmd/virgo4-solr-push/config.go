@@ -1,20 +1,32 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // ServiceConfig defines the service configuration parameters
 type ServiceConfig struct {
+	SourceType        string // the message source type (sqs or file)
+	SourcePath        string // for file sources, the directory, glob, tar archive or - for stdin
 	InQueueName       string // SQS queue name for inbound documents
 	PollTimeOut       int64  // the SQS queue timeout (in seconds)
 	MessageBucketName string // the bucket to use for large messages
+	FailureQueueName  string // SQS queue name for documents rejected by SOLR (optional)
 
+	DestinationName      string // the name of the destination the SOLR settings are for
+	DestinationRequired  bool   // is the destination the SOLR settings are for required
 	SolrUrl              string // the SOLR endpoint URL
 	SolrCoreName         string // the SOLR core name
-	SolrMode             string // the SOLR operation mode (add or delete)
+	SolrUniqueKey        string // the SOLR uniqueKey field name, discovered from the schema API if not set
+	SolrMode             string // the default SOLR operation mode (add or delete), messages may override it
+	SolrFormat           string // the SOLR update wire format (xml or json)
+	SolrUpdateChain      string // the tolerant update chain to use (optional)
+	SolrMaxErrors        int    // the maximum number of failing documents the tolerant update chain accepts (-1 for unlimited)
+	SolrGzip             bool   // gzip compress update requests
 	SolrTimeout          int    // the http timeout (in seconds)
 	SolrBlockCount       uint   // the maximum number of Solr AddDocs in a buffer sent to SOLR
 	SolrBufferSize       uint   // the maximum size of the buffer sent to SOLR
@@ -22,8 +34,48 @@ type ServiceConfig struct {
 	SolrCommitTime       int    // how often to do a SOLR commit if dirty (in seconds)
 	SolrCommitWithinTime int    // send SOLR a commit within after a document add (in seconds)
 
+	HttpRetries     int   // the maximum number of attempts for each SOLR request
+	HttpRetryBase   int   // the delay before the first retry (in milliseconds)
+	HttpRetryMax    int   // the maximum delay between retries (in milliseconds)
+	HttpRetryStatus []int // the HTTP status codes that are retried
+
+	AdaptiveBatching      bool // adjust the block count from the observed add latency and error rate and flush sooner when the inbound queue is nearly empty
+	SolrMinBlockCount     uint // the smallest block count used by adaptive batching, the block count is the largest
+	AdaptiveTargetLatency int  // the add latency adaptive batching aims for (in milliseconds)
+	SolrQuietFlushTime    int  // the flush time used by adaptive batching when the inbound queue is nearly empty (in milliseconds)
+
+	SolrMaxConcurrency int // the maximum number of concurrent update and commit requests to each destination by all the workers, zero for no limit
+	SolrMinConcurrency int // the limit is never reduced below this
+	SolrLatencyTarget  int // update and commit requests slower than this reduce the limit (in milliseconds), zero to only use failures
+
+	Destinations []DestinationConfig // all the SOLR destinations, the first is the primary one defined above
+
 	WorkerQueueSize int // the inbound message queue size to feed the workers
 	Workers         int // the number of worker processes
+	MemoryBudget    int // the memory the workers may use to buffer documents (in MB), zero for no limit
+	InFlightBatches int // the number of batches each worker may be adding to a required destination while it buffers the next, zero to wait for each one
+
+	ServicePort    int // the port for the HTTP service endpoints (metrics and health), zero to disable
+	LivenessWindow int // a worker that has made no progress in this time is not live (in seconds)
+	SolrPingTime   int // how often each worker pings SOLR to report readiness (in seconds)
+
+	ShutdownDeadline int // how long we wait for the workers to add and commit their buffers during shutdown (in seconds)
+
+	RetryBackoff           int // how long to wait after the first SOLR failure before trying again (in seconds)
+	RetryBackoffMax        int // the maximum time to wait between SOLR retries (in seconds)
+	MaxConsecutiveFailures int // exit after this many consecutive failures of a required destination, zero to never give up
+	MaxWorkerRestarts      int // exit after a worker has been restarted this many times, zero to never give up
+
+	BreakerThreshold int // the number of consecutive SOLR failures that opens the circuit breaker, zero to disable
+	BreakerProbeTime int // how often we probe SOLR while the circuit breaker is open (in seconds)
+
+	ValidatePayloads bool // check and normalize each payload before it is buffered, rejecting those that would spoil the batch
+	VerifyIds        bool // compare the id attribute of each message with the uniqueKey field in the payload
+
+	ProcessorConfig string // the document processor chain configuration file, optional
+
+	VersionAttribute string // the message attribute holding the document version, if not set we use the time the message was sent
+	VersionField     string // the document field the version is written to so SOLR can reject stale writes (the doc-based versioning field, not _version_), optional
 
 	SubDocIdDelimiter string // in cases where we are pushing AddDoc's containing sub-documents
 	// failures in sub-documents will be reported therefor we need a way to
@@ -31,6 +83,37 @@ type ServiceConfig struct {
 	// this is done with a special delimiter
 }
 
+// DestinationConfig defines the configuration for a single SOLR destination
+type DestinationConfig struct {
+	Name                 string // the destination name (used for logging)
+	Required             bool   // must this destination accept a document before it is removed from the inbound queue
+	SolrUrl              string // the SOLR endpoint URL
+	SolrCoreName         string // the SOLR core name
+	SolrTimeout          int    // the http timeout (in seconds)
+	SolrBlockCount       uint   // the maximum number of Solr AddDocs in a buffer sent to SOLR
+	SolrBufferSize       uint   // the maximum size of the buffer sent to SOLR
+	SolrFlushTime        int    // how often to flush the AddDocs buffer
+	SolrCommitTime       int    // how often to do a SOLR commit if dirty (in seconds)
+	SolrCommitWithinTime int    // send SOLR a commit within after a document add (in seconds)
+}
+
+// ForDestination returns a copy of the service configuration with the SOLR settings for the specified destination
+func (cfg *ServiceConfig) ForDestination(dest DestinationConfig) ServiceConfig {
+
+	destCfg := *cfg
+	destCfg.DestinationName = dest.Name
+	destCfg.DestinationRequired = dest.Required
+	destCfg.SolrUrl = dest.SolrUrl
+	destCfg.SolrCoreName = dest.SolrCoreName
+	destCfg.SolrTimeout = dest.SolrTimeout
+	destCfg.SolrBlockCount = dest.SolrBlockCount
+	destCfg.SolrBufferSize = dest.SolrBufferSize
+	destCfg.SolrFlushTime = dest.SolrFlushTime
+	destCfg.SolrCommitTime = dest.SolrCommitTime
+	destCfg.SolrCommitWithinTime = dest.SolrCommitWithinTime
+	return destCfg
+}
+
 func envWithDefault(env string, defaultValue string) string {
 	val, set := os.LookupEnv(env)
 
@@ -64,6 +147,66 @@ func ensureSetAndNonEmpty(env string) string {
 	return val
 }
 
+func envToIntWithDefault(env string, defaultValue int) int {
+
+	number := envWithDefault(env, strconv.Itoa(defaultValue))
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		log.Printf("environment variable is not a number: [%s]", env)
+		os.Exit(1)
+	}
+	return n
+}
+
+func envToBoolWithDefault(env string, defaultValue bool) bool {
+
+	value := envWithDefault(env, strconv.FormatBool(defaultValue))
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("environment variable is not a boolean: [%s]", env)
+		os.Exit(1)
+	}
+	return b
+}
+
+func envToIntListWithDefault(env string, defaultValue string) []int {
+
+	value := envWithDefault(env, defaultValue)
+	list := make([]int, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			log.Printf("environment variable is not a list of numbers: [%s]", env)
+			os.Exit(1)
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// load the configuration for an additional SOLR destination, anything not specified is the same as the primary
+func loadDestination(cfg *ServiceConfig, name string) DestinationConfig {
+
+	prefix := fmt.Sprintf("VIRGO4_SOLR_PUSH_%s_", strings.ToUpper(name))
+
+	var dest DestinationConfig
+	dest.Name = name
+	dest.Required = envToBoolWithDefault(prefix+"REQUIRED", true)
+	dest.SolrUrl = ensureSetAndNonEmpty(prefix + "SOLR_URL")
+	dest.SolrCoreName = envWithDefault(prefix+"SOLR_CORE", cfg.SolrCoreName)
+	dest.SolrTimeout = envToIntWithDefault(prefix+"SOLR_TIMEOUT", cfg.SolrTimeout)
+	dest.SolrBlockCount = uint(envToIntWithDefault(prefix+"SOLR_BLOCK_COUNT", int(cfg.SolrBlockCount)))
+	dest.SolrBufferSize = uint(envToIntWithDefault(prefix+"SOLR_BUFFER_SIZE", int(cfg.SolrBufferSize)))
+	dest.SolrFlushTime = envToIntWithDefault(prefix+"SOLR_FLUSH_TIME", cfg.SolrFlushTime)
+	dest.SolrCommitTime = envToIntWithDefault(prefix+"SOLR_COMMIT_TIME", cfg.SolrCommitTime)
+	dest.SolrCommitWithinTime = envToIntWithDefault(prefix+"SOLR_COMMIT_WITHIN_TIME", cfg.SolrCommitWithinTime)
+	return dest
+}
+
 func envToInt(env string) int {
 
 	number := ensureSetAndNonEmpty(env)
@@ -81,13 +224,28 @@ func LoadConfiguration() *ServiceConfig {
 
 	var cfg ServiceConfig
 
-	cfg.InQueueName = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_IN_QUEUE")
-	cfg.PollTimeOut = int64(envToInt("VIRGO4_SOLR_PUSH_QUEUE_POLL_TIMEOUT"))
-	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
+	cfg.SourceType = envWithDefault("VIRGO4_SOLR_PUSH_SOURCE", "sqs")
+	switch cfg.SourceType {
+	case "sqs":
+		cfg.InQueueName = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_IN_QUEUE")
+		cfg.PollTimeOut = int64(envToInt("VIRGO4_SOLR_PUSH_QUEUE_POLL_TIMEOUT"))
+		cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
+		cfg.FailureQueueName = envWithDefault("VIRGO4_SOLR_PUSH_FAILURE_QUEUE", "")
+	case "file":
+		cfg.SourcePath = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_SOURCE_PATH")
+	default:
+		log.Printf("ERROR: unsupported message source [%s]", cfg.SourceType)
+		os.Exit(1)
+	}
 
 	cfg.SolrUrl = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_SOLR_URL")
 	cfg.SolrCoreName = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_SOLR_CORE")
+	cfg.SolrUniqueKey = envWithDefault("VIRGO4_SOLR_PUSH_SOLR_UNIQUE_KEY", "")
 	cfg.SolrMode = ensureSetAndNonEmpty("VIRGO4_SOLR_PUSH_SOLR_MODE")
+	cfg.SolrFormat = envWithDefault("VIRGO4_SOLR_PUSH_SOLR_FORMAT", "xml")
+	cfg.SolrUpdateChain = envWithDefault("VIRGO4_SOLR_PUSH_SOLR_UPDATE_CHAIN", "")
+	cfg.SolrMaxErrors = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_MAX_ERRORS", -1)
+	cfg.SolrGzip = envToBoolWithDefault("VIRGO4_SOLR_PUSH_SOLR_GZIP", false)
 	cfg.SolrTimeout = envToInt("VIRGO4_SOLR_PUSH_SOLR_TIMEOUT")
 	cfg.SolrBlockCount = uint(envToInt("VIRGO4_SOLR_PUSH_SOLR_BLOCK_COUNT"))
 	cfg.SolrBufferSize = uint(envToInt("VIRGO4_SOLR_PUSH_SOLR_BUFFER_SIZE"))
@@ -95,33 +253,158 @@ func LoadConfiguration() *ServiceConfig {
 	cfg.SolrCommitTime = envToInt("VIRGO4_SOLR_PUSH_SOLR_COMMIT_TIME")
 	cfg.SolrCommitWithinTime = envToInt("VIRGO4_SOLR_PUSH_SOLR_COMMIT_WITHIN_TIME")
 
+	cfg.HttpRetries = envToIntWithDefault("VIRGO4_SOLR_PUSH_HTTP_RETRIES", 3)
+	cfg.HttpRetryBase = envToIntWithDefault("VIRGO4_SOLR_PUSH_HTTP_RETRY_BASE", 100)
+	cfg.HttpRetryMax = envToIntWithDefault("VIRGO4_SOLR_PUSH_HTTP_RETRY_MAX", 5000)
+	cfg.HttpRetryStatus = envToIntListWithDefault("VIRGO4_SOLR_PUSH_HTTP_RETRY_STATUS", "429,502,503,504")
+
+	cfg.AdaptiveBatching = envToBoolWithDefault("VIRGO4_SOLR_PUSH_ADAPTIVE_BATCHING", false)
+	cfg.SolrMinBlockCount = uint(envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_MIN_BLOCK_COUNT", 1))
+	cfg.AdaptiveTargetLatency = envToIntWithDefault("VIRGO4_SOLR_PUSH_ADAPTIVE_TARGET_LATENCY", 2000)
+	cfg.SolrQuietFlushTime = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_QUIET_FLUSH_TIME", 250)
+
+	cfg.SolrMaxConcurrency = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_MAX_CONCURRENCY", 0)
+	cfg.SolrMinConcurrency = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_MIN_CONCURRENCY", 1)
+	cfg.SolrLatencyTarget = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_LATENCY_TARGET", 10000)
+
+	// the primary destination is always required
+	cfg.DestinationName = "primary"
+	cfg.DestinationRequired = true
+	cfg.Destinations = append(cfg.Destinations, DestinationConfig{
+		Name:                 cfg.DestinationName,
+		Required:             true,
+		SolrUrl:              cfg.SolrUrl,
+		SolrCoreName:         cfg.SolrCoreName,
+		SolrTimeout:          cfg.SolrTimeout,
+		SolrBlockCount:       cfg.SolrBlockCount,
+		SolrBufferSize:       cfg.SolrBufferSize,
+		SolrFlushTime:        cfg.SolrFlushTime,
+		SolrCommitTime:       cfg.SolrCommitTime,
+		SolrCommitWithinTime: cfg.SolrCommitWithinTime,
+	})
+
+	// any additional destinations
+	destinations := envWithDefault("VIRGO4_SOLR_PUSH_DESTINATIONS", "")
+	if len(destinations) != 0 {
+		for _, name := range strings.Split(destinations, ",") {
+			cfg.Destinations = append(cfg.Destinations, loadDestination(&cfg, strings.TrimSpace(name)))
+		}
+	}
+
 	cfg.WorkerQueueSize = envToInt("VIRGO4_SOLR_PUSH_WORK_QUEUE_SIZE")
 	cfg.Workers = envToInt("VIRGO4_SOLR_PUSH_WORKERS")
+	cfg.MemoryBudget = envToIntWithDefault("VIRGO4_SOLR_PUSH_MEMORY_BUDGET", 0)
+	cfg.InFlightBatches = envToIntWithDefault("VIRGO4_SOLR_PUSH_IN_FLIGHT_BATCHES", 0)
 
+	cfg.ValidatePayloads = envToBoolWithDefault("VIRGO4_SOLR_PUSH_VALIDATE_PAYLOADS", false)
+	cfg.VerifyIds = envToBoolWithDefault("VIRGO4_SOLR_PUSH_VERIFY_IDS", false)
+	cfg.ProcessorConfig = envWithDefault("VIRGO4_SOLR_PUSH_PROCESSOR_CONFIG", "")
+	cfg.VersionAttribute = envWithDefault("VIRGO4_SOLR_PUSH_VERSION_ATTRIBUTE", "")
+	cfg.VersionField = envWithDefault("VIRGO4_SOLR_PUSH_VERSION_FIELD", "")
 	cfg.SubDocIdDelimiter = envWithDefault("SOLR_PUSH_SUBDOC_ID_DELIMITER", "")
 
+	cfg.ServicePort = envToIntWithDefault("VIRGO4_SOLR_PUSH_SERVICE_PORT", 8080)
+	cfg.LivenessWindow = envToIntWithDefault("VIRGO4_SOLR_PUSH_LIVENESS_WINDOW", 60)
+	cfg.SolrPingTime = envToIntWithDefault("VIRGO4_SOLR_PUSH_SOLR_PING_TIME", 30)
+	cfg.ShutdownDeadline = envToIntWithDefault("VIRGO4_SOLR_PUSH_SHUTDOWN_DEADLINE", 30)
+
+	cfg.RetryBackoff = envToIntWithDefault("VIRGO4_SOLR_PUSH_RETRY_BACKOFF", 1)
+	cfg.RetryBackoffMax = envToIntWithDefault("VIRGO4_SOLR_PUSH_RETRY_BACKOFF_MAX", 60)
+	cfg.MaxConsecutiveFailures = envToIntWithDefault("VIRGO4_SOLR_PUSH_MAX_CONSECUTIVE_FAILURES", 0)
+	cfg.MaxWorkerRestarts = envToIntWithDefault("VIRGO4_SOLR_PUSH_MAX_WORKER_RESTARTS", 0)
+
+	cfg.BreakerThreshold = envToIntWithDefault("VIRGO4_SOLR_PUSH_BREAKER_THRESHOLD", 5)
+	cfg.BreakerProbeTime = envToIntWithDefault("VIRGO4_SOLR_PUSH_BREAKER_PROBE_TIME", 10)
+
+	log.Printf("[CONFIG] SourceType           = [%s]", cfg.SourceType)
+	log.Printf("[CONFIG] SourcePath           = [%s]", cfg.SourcePath)
 	log.Printf("[CONFIG] InQueueName          = [%s]", cfg.InQueueName)
 	log.Printf("[CONFIG] PollTimeOut          = [%d]", cfg.PollTimeOut)
 	log.Printf("[CONFIG] MessageBucketName    = [%s]", cfg.MessageBucketName)
+	log.Printf("[CONFIG] FailureQueueName     = [%s]", cfg.FailureQueueName)
 
 	log.Printf("[CONFIG] SolrUrl              = [%s]", cfg.SolrUrl)
 	log.Printf("[CONFIG] SolrCoreName         = [%s]", cfg.SolrCoreName)
+	log.Printf("[CONFIG] SolrUniqueKey        = [%s]", cfg.SolrUniqueKey)
 	log.Printf("[CONFIG] SolrMode             = [%s]", cfg.SolrMode)
+	log.Printf("[CONFIG] SolrFormat           = [%s]", cfg.SolrFormat)
+	log.Printf("[CONFIG] SolrUpdateChain      = [%s]", cfg.SolrUpdateChain)
+	log.Printf("[CONFIG] SolrMaxErrors        = [%d]", cfg.SolrMaxErrors)
+	log.Printf("[CONFIG] SolrGzip             = [%t]", cfg.SolrGzip)
 	log.Printf("[CONFIG] SolrTimeout          = [%d]", cfg.SolrTimeout)
 	log.Printf("[CONFIG] SolrBlockCount       = [%d]", cfg.SolrBlockCount)
 	log.Printf("[CONFIG] SolrBufferSize (MB)  = [%d]", cfg.SolrBufferSize)
 	log.Printf("[CONFIG] SolrFlushTime        = [%d]", cfg.SolrFlushTime)
 	log.Printf("[CONFIG] SolrCommitTime       = [%d]", cfg.SolrCommitTime)
 	log.Printf("[CONFIG] SolrCommitWithinTime = [%d]", cfg.SolrCommitWithinTime)
+	log.Printf("[CONFIG] HttpRetries          = [%d]", cfg.HttpRetries)
+	log.Printf("[CONFIG] HttpRetryBase (ms)   = [%d]", cfg.HttpRetryBase)
+	log.Printf("[CONFIG] HttpRetryMax (ms)    = [%d]", cfg.HttpRetryMax)
+	log.Printf("[CONFIG] HttpRetryStatus      = %v", cfg.HttpRetryStatus)
+	log.Printf("[CONFIG] AdaptiveBatching     = [%t]", cfg.AdaptiveBatching)
+	log.Printf("[CONFIG] SolrMinBlockCount    = [%d]", cfg.SolrMinBlockCount)
+	log.Printf("[CONFIG] AdaptiveTarget (ms)  = [%d]", cfg.AdaptiveTargetLatency)
+	log.Printf("[CONFIG] QuietFlushTime (ms)  = [%d]", cfg.SolrQuietFlushTime)
+	log.Printf("[CONFIG] SolrMaxConcurrency   = [%d]", cfg.SolrMaxConcurrency)
+	log.Printf("[CONFIG] SolrMinConcurrency   = [%d]", cfg.SolrMinConcurrency)
+	log.Printf("[CONFIG] LatencyTarget (ms)   = [%d]", cfg.SolrLatencyTarget)
+
+	for _, d := range cfg.Destinations[1:] {
+		log.Printf("[CONFIG] Destination %s: url [%s], core [%s], required [%t], timeout [%d], block count [%d], buffer size [%d], flush time [%d], commit time [%d], commit within [%d]",
+			d.Name, d.SolrUrl, d.SolrCoreName, d.Required, d.SolrTimeout, d.SolrBlockCount, d.SolrBufferSize, d.SolrFlushTime, d.SolrCommitTime, d.SolrCommitWithinTime)
+	}
 
 	log.Printf("[CONFIG] WorkerQueueSize      = [%d]", cfg.WorkerQueueSize)
 	log.Printf("[CONFIG] Workers              = [%d]", cfg.Workers)
+	log.Printf("[CONFIG] MemoryBudget (MB)    = [%d]", cfg.MemoryBudget)
+	log.Printf("[CONFIG] InFlightBatches      = [%d]", cfg.InFlightBatches)
+	log.Printf("[CONFIG] ValidatePayloads     = [%t]", cfg.ValidatePayloads)
+	log.Printf("[CONFIG] VerifyIds            = [%t]", cfg.VerifyIds)
+	log.Printf("[CONFIG] ProcessorConfig      = [%s]", cfg.ProcessorConfig)
+	log.Printf("[CONFIG] VersionAttribute     = [%s]", cfg.VersionAttribute)
+	log.Printf("[CONFIG] VersionField         = [%s]", cfg.VersionField)
 	log.Printf("[CONFIG] SubDocIdDelimiter    = [%s]", cfg.SubDocIdDelimiter)
+	log.Printf("[CONFIG] ServicePort          = [%d]", cfg.ServicePort)
+	log.Printf("[CONFIG] LivenessWindow       = [%d]", cfg.LivenessWindow)
+	log.Printf("[CONFIG] SolrPingTime         = [%d]", cfg.SolrPingTime)
+	log.Printf("[CONFIG] ShutdownDeadline     = [%d]", cfg.ShutdownDeadline)
+	log.Printf("[CONFIG] RetryBackoff         = [%d]", cfg.RetryBackoff)
+	log.Printf("[CONFIG] RetryBackoffMax      = [%d]", cfg.RetryBackoffMax)
+	log.Printf("[CONFIG] MaxConsecFailures    = [%d]", cfg.MaxConsecutiveFailures)
+	log.Printf("[CONFIG] MaxWorkerRestarts    = [%d]", cfg.MaxWorkerRestarts)
+	log.Printf("[CONFIG] BreakerThreshold     = [%d]", cfg.BreakerThreshold)
+	log.Printf("[CONFIG] BreakerProbeTime     = [%d]", cfg.BreakerProbeTime)
 
 	if cfg.SolrCommitTime == 0 {
 		log.Printf("INFO: commit time is zero, explicit SOLR commits are DISABLED!!")
 	}
 
+	if cfg.SolrFormat != "xml" && cfg.SolrFormat != "json" {
+		log.Printf("ERROR: unsupported SOLR format [%s]", cfg.SolrFormat)
+		os.Exit(1)
+	}
+
+	// the file source reads SOLR XML documents, they cannot be sent as JSON
+	if cfg.SourceType == "file" && cfg.SolrFormat != "xml" {
+		log.Printf("ERROR: the file source only supports the xml SOLR format, not [%s]", cfg.SolrFormat)
+		os.Exit(1)
+	}
+
+	// any _version_ above 1 must match the indexed version exactly so every add would fail
+	if cfg.VersionField == "_version_" {
+		log.Printf("ERROR: the version field must be a doc-based versioning field, not _version_")
+		os.Exit(1)
+	}
+
+	if cfg.InFlightBatches < 0 {
+		log.Printf("ERROR: in flight batches cannot be negative [%d]", cfg.InFlightBatches)
+		os.Exit(1)
+	}
+
+	if cfg.SourceType == "sqs" && len(cfg.FailureQueueName) == 0 {
+		log.Printf("INFO: failure queue is not configured, rejected documents will NOT be removed from the inbound queue")
+	}
+
 	if cfg.SolrCommitWithinTime == 0 {
 		log.Printf("INFO: commit time is zero, SOLR commit within is DISABLED!!")
 	}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a single SOLR destination as seen by a worker
+type destination struct {
+	name       string                      // the destination name
+	required   bool                        // must this destination accept a document before it is removed from the inbound queue
+	config     ServiceConfig               // the configuration for this destination
+	solr       SOLR                        // our SOLR instance
+	queued     []awssqs.Message            // the messages buffered to SOLR but not yet added
+	superseded map[string][]awssqs.Message // older copies of the queued documents, by id, settled with the queued one
+	lastPing   time.Time                   // when we last pinged SOLR
+	backoff    *backoff                    // consecutive add and commit failures
+	breaker    *circuitBreaker             // shared with the other workers using this destination
+	workerId   int                         // used for logging
+}
+
+// the outcome of a flush
+type flushResult struct {
+	accepted  []awssqs.Message  // the messages added to SOLR
+	rejected  []rejectedMessage // the messages rejected by SOLR
+	abandoned []awssqs.Message  // the messages we gave up on, they will be redelivered
+}
+
+// a single message rejected by SOLR
+type rejectedMessage struct {
+	message   awssqs.Message
+	rejection Rejection
+}
+
+// create a new destination for the specified worker
+func newDestination(workerId int, config *ServiceConfig, dest DestinationConfig, stop <-chan struct{}) (*destination, error) {
+
+	d := &destination{name: dest.Name, required: dest.Required, config: config.ForDestination(dest), workerId: workerId}
+	d.breaker = circuitBreakerFor(dest.Name)
+	d.backoff = newBackoff(time.Duration(config.RetryBackoff)*time.Second, time.Duration(config.RetryBackoffMax)*time.Second)
+
+	var err error
+	d.solr, err = NewSolr(workerId, d.config, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	// we have just successfully pinged SOLR
+	d.lastPing = time.Now()
+	serviceHealth.pinged(workerId, d.name, d.required, nil)
+
+	d.queued = make([]awssqs.Message, 0, d.config.SolrBlockCount)
+	d.superseded = make(map[string][]awssqs.Message)
+	return d, nil
+}
+
+// create a new destination, retrying until SOLR is available or we are told to stop (returns nil)
+func connectDestination(workerId int, config *ServiceConfig, dest DestinationConfig, stop <-chan struct{}) *destination {
+
+	retry := newBackoff(time.Duration(config.RetryBackoff)*time.Second, time.Duration(config.RetryBackoffMax)*time.Second)
+	for {
+		d, err := newDestination(workerId, config, dest, stop)
+		if err == nil {
+			return d
+		}
+
+		delay := retry.failed()
+		serviceHealth.pinged(workerId, dest.Name, dest.Required, err)
+		log.Printf("worker %d: ERROR %s is not available, retrying in %s (%s)", workerId, dest.Name, delay, err.Error())
+		if config.MaxConsecutiveFailures != 0 && retry.failures >= config.MaxConsecutiveFailures {
+			log.Fatalf("FATAL ERROR: worker %d: %s failed %d consecutive times, giving up", workerId, dest.Name, retry.failures)
+		}
+
+		serviceHealth.waiting(workerId, "connecting", delay)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// buffer a message to SOLR and add it to the queued list. Messages are often delivered more than once so if we
+// already have a copy of the document queued, only the newest one is sent
+func (d *destination) buffer(message awssqs.Message) error {
+
+	id, found := message.GetAttribute(awssqs.AttributeKeyRecordId)
+	if found == true {
+		for ix, queued := range d.queued {
+			if queuedId, _ := queued.GetAttribute(awssqs.AttributeKeyRecordId); queuedId != id {
+				continue
+			}
+
+			documentsSuperseded.WithLabelValues(d.name).Inc()
+
+			if d.isNewer(message, queued) == false {
+				log.Printf("worker %d: INFO %s already has a newer copy of id %s, superseding this one", d.workerId, d.name, id)
+				d.superseded[id] = append(d.superseded[id], message)
+				return nil
+			}
+
+			// replace the queued copy, SOLR buffers cannot be edited so we buffer everything again
+			log.Printf("worker %d: INFO %s superseding the queued copy of id %s", d.workerId, d.name, id)
+			d.superseded[id] = append(d.superseded[id], queued)
+			d.queued[ix] = message
+			return d.rebuffer()
+		}
+	}
+
+	err := bufferMessage(d.solr, &d.config, message)
+	if err != nil {
+		return err
+	}
+
+	d.queued = append(d.queued, message)
+	return nil
+}
+
+// is the candidate message a newer copy of the document than the current one. We use the version attribute
+// if both have one, otherwise the time they were sent. In a tie, the candidate (the one received last) wins
+func (d *destination) isNewer(candidate awssqs.Message, current awssqs.Message) bool {
+
+	if len(d.config.VersionAttribute) != 0 {
+		candidateVersion, candidateFound := candidate.GetAttribute(d.config.VersionAttribute)
+		currentVersion, currentFound := current.GetAttribute(d.config.VersionAttribute)
+		if candidateFound == true && currentFound == true {
+			candidateNum, candidateErr := strconv.ParseInt(candidateVersion, 10, 64)
+			currentNum, currentErr := strconv.ParseInt(currentVersion, 10, 64)
+			if candidateErr == nil && currentErr == nil {
+				return candidateNum >= currentNum
+			}
+			return candidateVersion >= currentVersion
+		}
+	}
+
+	return candidate.FirstSent >= current.FirstSent
+}
+
+// discard the SOLR buffer and buffer the queued messages again
+func (d *destination) rebuffer() error {
+
+	d.solr.ClearBuffer()
+	for _, m := range d.queued {
+		err := bufferMessage(d.solr, &d.config, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add the queued messages to SOLR and settle any superseded copies of them
+func (d *destination) flush() (flushResult, error) {
+
+	result, err := d.add()
+	d.settleSuperseded(&result)
+	return result, err
+}
+
+// the superseded copies of a document are done with once the newest copy is added or rejected and are
+// abandoned with it otherwise
+func (d *destination) settleSuperseded(result *flushResult) {
+
+	if len(d.superseded) == 0 {
+		return
+	}
+
+	take := func(message awssqs.Message) []awssqs.Message {
+		id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+		superseded := d.superseded[id]
+		delete(d.superseded, id)
+		return superseded
+	}
+
+	accepted := make([]awssqs.Message, 0)
+	abandoned := make([]awssqs.Message, 0)
+	for _, m := range result.accepted {
+		accepted = append(accepted, take(m)...)
+	}
+	for _, r := range result.rejected {
+		accepted = append(accepted, take(r.message)...)
+	}
+	for _, m := range result.abandoned {
+		abandoned = append(abandoned, take(m)...)
+	}
+	result.accepted = append(result.accepted, accepted...)
+	result.abandoned = append(result.abandoned, abandoned...)
+}
+
+// add the queued messages to SOLR. We try to rebuffer and reprocess any documents that were not processed
+// because of a failure in another document. Any other error is returned.
+func (d *destination) add() (flushResult, error) {
+
+	var result flushResult
+
+	for {
+
+		// add them
+		added, err := d.solr.ForceAdd()
+		failedDoc := added.FailedDoc
+
+		switch err {
+
+		// no error, everything OK
+		case nil:
+			// reject any reported by a tolerant update chain and accept the rest. If we cannot tell which
+			// document an error is for, one of the rest was rejected so we find it by bisecting them
+			_, matched := d.rejectErrors(added.Errors, &result)
+			if matched == false && len(d.queued) != 0 {
+				log.Printf("worker %d: WARNING %s cannot locate every failing id, bisecting the remaining %d documents", d.workerId, d.name, len(d.queued))
+				return d.bisect(result)
+			}
+			result.accepted = append(result.accepted, d.queued...)
+
+			// clear the queue
+			d.queued = d.queued[:0]
+
+		// one of the documents failed
+		case ErrDocumentAdd:
+
+			// convert the failed document number to a document index
+			failedIx, cerr := strconv.Atoi(failedDoc)
+			failedIx--
+
+			// how many do we have total
+			sz := len(d.queued)
+
+			// if we cannot tell which document failed
+			if cerr != nil || failedIx < 0 || failedIx >= sz {
+				log.Printf("worker %d: WARNING %s cannot locate doc number %s in batch of %d, bisecting the batch", d.workerId, d.name, failedDoc, sz)
+				return d.bisect(result)
+			}
+
+			// if the failure document was the first one
+			if failedIx == 0 {
+
+				log.Printf("worker %d: WARNING %s first document in batch of %d failed, ignoring it and requing the remainder", d.workerId, d.name, sz)
+
+				// reject the failed one
+				result.rejected = append(result.rejected, d.reject(d.queued[0], failedDoc, rejectReasonDocumentNumber))
+
+				// ignore the one that failed and keep the remainder
+				d.queued = d.queued[1:]
+
+				// if the failure document was not the last one
+			} else if failedIx < sz-1 {
+
+				log.Printf("worker %d: WARNING %s purging documents 0 - %d, ignoring document %d, requeuing %d - %d",
+					d.workerId, d.name, failedIx-1, failedIx, failedIx+1, sz)
+
+				// accept the ones that succeeded
+				result.accepted = append(result.accepted, d.queued[0:failedIx]...)
+
+				// reject the failed one
+				result.rejected = append(result.rejected, d.reject(d.queued[failedIx], failedDoc, rejectReasonDocumentNumber))
+
+				// ignore the one that failed and keep the remainder
+				d.queued = d.queued[failedIx+1:]
+
+				// the failure document was the last one
+			} else {
+				log.Printf("worker %d: WARNING %s last document in batch of %d failed, ignoring it", d.workerId, d.name, sz)
+
+				// accept all but the last of them
+				result.accepted = append(result.accepted, d.queued[0:failedIx]...)
+
+				// reject the failed one
+				result.rejected = append(result.rejected, d.reject(d.queued[failedIx], failedDoc, rejectReasonDocumentNumber))
+
+				// clear the queue
+				d.queued = d.queued[:0]
+			}
+
+		// a newer copy of one of the documents is already indexed, we are done with that one
+		case ErrVersionConflict:
+
+			ix := d.queuedIndex(d.parentId(failedDoc))
+			if ix < 0 && len(d.queued) == 1 {
+				ix = 0
+			}
+			if ix < 0 {
+				log.Printf("worker %d: WARNING %s cannot locate the conflicting document, bisecting the batch", d.workerId, d.name)
+				return d.bisect(result)
+			}
+
+			log.Printf("worker %d: INFO %s newer copy of id/doc number %s already indexed, requing the remainder", d.workerId, d.name, failedDoc)
+			documentsStale.WithLabelValues(d.name).Inc()
+			result.accepted = append(result.accepted, d.queued[ix])
+			d.queued = append(d.queued[:ix], d.queued[ix+1:]...)
+
+		// all of the adds failed, attempt to handle as best we can...
+		case ErrAllDocumentAdd:
+
+			// a tolerant update chain that exceeded the maximum number of errors tells us about all of them
+			if settled, _ := d.rejectErrors(added.Errors, &result); settled != 0 {
+				log.Printf("worker %d: WARNING %s update chain reported %d failures, requing the remainder", d.workerId, d.name, len(added.Errors))
+				break
+			}
+
+			// if we were able to identify the document that failed then we might be able to handle
+			// things in a sensible manner. If we cannot, it's all over
+
+			if len(failedDoc) != 0 {
+
+				log.Printf("worker %d: WARNING %s all documents failed due to id/doc number %s, attempting to recover", d.workerId, d.name, failedDoc)
+
+				// if we are configured for sub-document delimiters, this might be a sub-document id so
+				// attempt to extract the parent document id so we can remove it from the block
+				if len(d.config.SubDocIdDelimiter) != 0 {
+					parentID := strings.Split(failedDoc, d.config.SubDocIdDelimiter)
+					if parentID[0] != failedDoc {
+						failedDoc = parentID[0]
+						log.Printf("worker %d: WARNING %s extracted parent id (%s) from id/doc number, looks like a sub-document failure ", d.workerId, d.name, failedDoc)
+					}
+				}
+
+				// iterate through and remove the bad item
+				failedItemRemoved := false
+				for ix, m := range d.queued {
+					recId, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+					if recId == failedDoc {
+						log.Printf("worker %d: WARNING %s removed id/doc number %s, requing the remainder", d.workerId, d.name, failedDoc)
+						result.rejected = append(result.rejected, d.reject(m, failedDoc, rejectReasonDocumentId))
+						d.queued = append(d.queued[:ix], d.queued[ix+1:]...)
+						failedItemRemoved = true
+						break
+					}
+				}
+
+				// if we did not remove any items, lets assume that the failed doc is a document *number* instead of a document ID.
+				// remove that one from the list. When we are handling a ErrAllDocumentAdd error, the failed document number
+				// should *always* be 1 (the first document).
+
+				if failedItemRemoved == false {
+
+					if failedDoc == "1" {
+						log.Printf("worker %d: WARNING %s removed first doc in list, requing the remainder", d.workerId, d.name)
+						result.rejected = append(result.rejected, d.reject(d.queued[0], failedDoc, rejectReasonDocumentNumber))
+						d.queued = d.queued[1:]
+					} else {
+						log.Printf("worker %d: WARNING %s cannot locate id/doc number %s in our list, bisecting the batch", d.workerId, d.name, failedDoc)
+						return d.bisect(result)
+					}
+				}
+			} else {
+				log.Printf("worker %d: WARNING %s cannot determine id/doc number from the reported failure, bisecting the batch", d.workerId, d.name)
+				return d.bisect(result)
+			}
+
+		default:
+			return result, err
+		}
+
+		// we have processed all the queued items, break out of the loop
+		if len(d.queued) == 0 {
+			return result, nil
+		}
+
+		// otherwise, re-buffer any that need to be reprocessed and try again
+		for _, m := range d.queued {
+			err = bufferMessage(d.solr, &d.config, m)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+}
+
+// the index of the queued message with the specified id, -1 if there is none
+func (d *destination) queuedIndex(id string) int {
+
+	if len(id) == 0 {
+		return -1
+	}
+
+	for ix, m := range d.queued {
+		if recId, _ := m.GetAttribute(awssqs.AttributeKeyRecordId); recId == id {
+			return ix
+		}
+	}
+	return -1
+}
+
+// if we are configured for sub-document delimiters, the id might be a sub-document id so get the parent id
+func (d *destination) parentId(id string) string {
+
+	if len(d.config.SubDocIdDelimiter) != 0 {
+		return strings.Split(id, d.config.SubDocIdDelimiter)[0]
+	}
+	return id
+}
+
+// reject the queued messages for the failing documents reported by a tolerant update chain, the others stay
+// queued. Version conflicts mean a newer copy is already indexed so those are accepted. Returns the number
+// settled and whether every failing document was found
+func (d *destination) rejectErrors(errors []DocumentError, result *flushResult) (int, bool) {
+
+	if len(errors) == 0 {
+		return 0, true
+	}
+
+	failed := make(map[string]DocumentError, len(errors))
+	for _, e := range errors {
+		failed[d.parentId(e.Id)] = e
+	}
+
+	count := 0
+	matched := make(map[string]bool, len(failed))
+	remaining := make([]awssqs.Message, 0, len(d.queued))
+	for _, m := range d.queued {
+		recId, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+		e, found := failed[recId]
+		if found == false {
+			remaining = append(remaining, m)
+			continue
+		}
+		if isVersionConflict(e.Message) == true {
+			documentsStale.WithLabelValues(d.name).Inc()
+			result.accepted = append(result.accepted, m)
+		} else {
+			documentsRejected.WithLabelValues(d.name, rejectReasonTolerant).Inc()
+			result.rejected = append(result.rejected, rejectedMessage{message: m, rejection: Rejection{Destination: d.name, FailedDoc: e.Id, Reason: e.Message}})
+		}
+		matched[recId] = true
+		count++
+	}
+
+	found := true
+	for id := range failed {
+		if matched[id] == false {
+			log.Printf("worker %d: WARNING %s cannot locate failing id %s in our list", d.workerId, d.name, id)
+			found = false
+		}
+	}
+
+	d.queued = remaining
+	return count, found
+}
+
+// SOLR rejected the batch without telling us which document was the problem. Split the batch in half and
+// add each half separately, splitting again until we isolate the offending documents. The documents are no
+// longer buffered to SOLR when we are called
+func (d *destination) bisect(result flushResult) (flushResult, error) {
+
+	batch := d.queued
+	d.queued = make([]awssqs.Message, 0, len(batch))
+
+	// a single document must be the problem
+	if len(batch) == 1 {
+		id, _ := batch[0].GetAttribute(awssqs.AttributeKeyRecordId)
+		log.Printf("worker %d: WARNING %s isolated failing id %s, rejecting it", d.workerId, d.name, id)
+		result.rejected = append(result.rejected, d.reject(batch[0], id, rejectReasonUnidentified))
+		return result, nil
+	}
+
+	mid := len(batch) / 2
+	halves := [][]awssqs.Message{batch[:mid], batch[mid:]}
+	log.Printf("worker %d: INFO %s splitting batch of %d into %d and %d", d.workerId, d.name, len(batch), len(halves[0]), len(halves[1]))
+
+	for ix, half := range halves {
+
+		// buffer and add this half, which may split it further
+		err := d.requeue(half)
+		if err == nil {
+			var sub flushResult
+			sub, err = d.add()
+			result.merge(sub)
+		}
+
+		// anything not yet added stays queued and buffered for the next attempt
+		if err != nil {
+			for _, remaining := range halves[ix+1:] {
+				if rerr := d.requeue(remaining); rerr != nil {
+					log.Printf("worker %d: ERROR %s requeue failed (%s)", d.workerId, d.name, rerr.Error())
+				}
+			}
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// buffer the messages to SOLR and add them to the queued list
+func (d *destination) requeue(messages []awssqs.Message) error {
+
+	for _, m := range messages {
+		err := d.buffer(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// give up on the queued messages and any superseded copies of them, they will be redelivered
+func (d *destination) abandon() []awssqs.Message {
+
+	abandoned := append([]awssqs.Message{}, d.queued...)
+	for id, superseded := range d.superseded {
+		abandoned = append(abandoned, superseded...)
+		delete(d.superseded, id)
+	}
+
+	d.queued = d.queued[:0]
+	d.solr.ClearBuffer()
+	return abandoned
+}
+
+// combine the result of a flush with this one
+func (r *flushResult) merge(other flushResult) {
+	r.accepted = append(r.accepted, other.accepted...)
+	r.rejected = append(r.rejected, other.rejected...)
+	r.abandoned = append(r.abandoned, other.abandoned...)
+}
+
+// commit if it is time to do so
+func (d *destination) commitIfTime() error {
+
+	if d.solr.IsTimeToCommit() == true {
+		return d.solr.ForceCommit()
+	}
+	return nil
+}
+
+// an add or commit failed, the documents remain buffered and we wait a while before trying again. Too many
+// consecutive failures of a required destination is fatal if we are configured that way
+func (d *destination) failed(operation string, err error) {
+
+	delay := d.backoff.failed()
+	log.Printf("worker %d: ERROR %s %s failed, retaining %d documents and retrying in %s (%s)", d.workerId, d.name, operation, len(d.queued), delay, err.Error())
+
+	if d.required == true && d.config.MaxConsecutiveFailures != 0 && d.backoff.failures >= d.config.MaxConsecutiveFailures {
+		log.Fatalf("FATAL ERROR: worker %d: %s failed %d consecutive times, giving up", d.workerId, d.name, d.backoff.failures)
+	}
+}
+
+// how long to wait for the next message before checking if it is time to add, shorter than the specified
+// wait if we have documents buffered and the flush time is short. Not while we are waiting after a failure
+// or SOLR is not available
+func (d *destination) flushWait(wait time.Duration) time.Duration {
+
+	if len(d.queued) != 0 && d.backoff.waiting() == false && d.breaker.isOpen() == false {
+		if flush := batchSizerFor(d.config).flushTime(); flush < wait {
+			return flush
+		}
+	}
+	return wait
+}
+
+// ping SOLR if it is time to do so and report the result
+func (d *destination) pingIfTime() {
+
+	if time.Since(d.lastPing) < time.Duration(d.config.SolrPingTime)*time.Second {
+		return
+	}
+
+	err := d.solr.IsAlive()
+	if err != nil {
+		log.Printf("worker %d: WARNING %s ping failed (%s)", d.workerId, d.name, err.Error())
+	}
+	d.lastPing = time.Now()
+	serviceHealth.pinged(d.workerId, d.name, d.required, err)
+}
+
+// make the rejection details for a message and count it, this is where each rejection is finally decided
+func (d *destination) reject(message awssqs.Message, failedDoc string, reason string) rejectedMessage {
+	documentsRejected.WithLabelValues(d.name, reason).Inc()
+	return rejectedMessage{message: message, rejection: Rejection{Destination: d.name, FailedDoc: failedDoc, Reason: d.solr.LastError()}}
+}
+
+//
+// end of file
+//
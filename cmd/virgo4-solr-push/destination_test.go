@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the configuration used by the tests
+func testConfig() ServiceConfig {
+	return ServiceConfig{
+		DestinationName: "test",
+		SolrCoreName:    "test",
+		SolrUniqueKey:   defaultUniqueKey,
+		SolrMode:        "add",
+		SolrFormat:      "xml",
+		SolrBlockCount:  100,
+		SolrFlushTime:   60,
+		SolrTimeout:     5,
+		SolrBufferSize:  10,
+	}
+}
+
+// a message containing a document with the specified id
+func testMessage(id string) awssqs.Message {
+	return awssqs.Message{
+		Attribs: awssqs.Attributes{{Name: awssqs.AttributeKeyRecordId, Value: id}},
+		Payload: []byte(fmt.Sprintf(`<doc><field name="id">%s</field></doc>`, id)),
+	}
+}
+
+// a destination using the fake SOLR implementation with the specified script
+func testDestination(t *testing.T, script string) (*destination, *solrFake) {
+
+	config := testConfig()
+	fake, err := newSolrFake(1, config, script)
+	if err != nil {
+		t.Fatalf("bad script [%s]: %s", script, err.Error())
+	}
+
+	d := &destination{name: config.DestinationName, required: true, config: config, solr: fake, workerId: 1}
+	d.backoff = newBackoff(time.Second, time.Second)
+	d.breaker = newCircuitBreaker(config.DestinationName, 0, 0)
+	d.superseded = make(map[string][]awssqs.Message)
+	return d, fake
+}
+
+// the ids of the messages
+func messageIds(messages []awssqs.Message) []string {
+
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		id, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// the ids of the rejected messages
+func rejectedIds(rejected []rejectedMessage) []string {
+
+	ids := make([]string, 0, len(rejected))
+	for _, r := range rejected {
+		id, _ := r.message.GetAttribute(awssqs.AttributeKeyRecordId)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestDestinationFlush(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		script    string
+		accepted  []string
+		rejected  []string
+		queued    []string
+		status    int    // the HTTP status of the error, if any
+		delimiter string // the sub-document id delimiter, if any
+	}{
+		{name: "all added", script: "ok",
+			accepted: []string{"a", "b", "c", "d"}, rejected: []string{}, queued: []string{}},
+		{name: "document number fails", script: "faildoc:2",
+			accepted: []string{"a", "c", "d"}, rejected: []string{"b"}, queued: []string{}},
+		{name: "last document number fails", script: "faildoc:4",
+			accepted: []string{"a", "b", "c"}, rejected: []string{"d"}, queued: []string{}},
+		{name: "document number out of range bisected", script: "faildoc:9,ok,reject,ok,reject",
+			accepted: []string{"a", "b", "c"}, rejected: []string{"d"}, queued: []string{}},
+		{name: "first document number fails", script: "faildoc:1",
+			accepted: []string{"b", "c", "d"}, rejected: []string{"a"}, queued: []string{}},
+		{name: "document id rejected", script: "rejectid:c",
+			accepted: []string{"a", "b", "d"}, rejected: []string{"c"}, queued: []string{}},
+		{name: "sub-document id rejected", script: "rejectid:c_1", delimiter: "_",
+			accepted: []string{"a", "b", "d"}, rejected: []string{"c"}, queued: []string{}},
+		{name: "first document number rejected", script: "rejectdoc:1",
+			accepted: []string{"b", "c", "d"}, rejected: []string{"a"}, queued: []string{}},
+		{name: "unknown document id bisected", script: "rejectid:x,ok,reject,reject",
+			accepted: []string{"a", "b", "d"}, rejected: []string{"c"}, queued: []string{}},
+		{name: "unidentified rejection bisected", script: "reject,reject,ok,reject",
+			accepted: []string{"a", "c", "d"}, rejected: []string{"b"}, queued: []string{}},
+		{name: "tolerant update chain errors", script: "errors:b;d",
+			accepted: []string{"a", "c"}, rejected: []string{"b", "d"}, queued: []string{}},
+		{name: "tolerant update chain unknown id bisected", script: "errors:x,ok,errors:x,ok,errors:x",
+			accepted: []string{"a", "b", "c"}, rejected: []string{"d"}, queued: []string{}},
+		{name: "tolerant update chain known and unknown ids", script: "errors:b;x,ok,errors:x,ok,errors:x",
+			accepted: []string{"a", "c"}, rejected: []string{"b", "d"}, queued: []string{}},
+		{name: "version conflict", script: "conflict:c",
+			accepted: []string{"c", "a", "b", "d"}, rejected: []string{}, queued: []string{}},
+		{name: "unidentified version conflict bisected", script: "conflict:x,ok,conflict:x,ok,conflict:x",
+			accepted: []string{"a", "b", "c", "d"}, rejected: []string{}, queued: []string{}},
+		{name: "request fails", script: "http:503",
+			accepted: []string{}, rejected: []string{}, queued: []string{"a", "b", "c", "d"}, status: 503},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			d, _ := testDestination(t, test.script)
+			d.config.SubDocIdDelimiter = test.delimiter
+			for _, id := range []string{"a", "b", "c", "d"} {
+				if err := d.buffer(testMessage(id)); err != nil {
+					t.Fatalf("buffer failed: %s", err.Error())
+				}
+			}
+
+			result, err := d.flush()
+
+			var statusErr *HttpStatusError
+			switch {
+			case test.status == 0 && err != nil:
+				t.Fatalf("unexpected error: %s", err.Error())
+			case test.status != 0 && (errors.As(err, &statusErr) == false || statusErr.StatusCode != test.status):
+				t.Fatalf("expected HTTP %d, got %v", test.status, err)
+			}
+
+			if got := messageIds(result.accepted); reflect.DeepEqual(got, test.accepted) == false {
+				t.Errorf("accepted %v, expected %v", got, test.accepted)
+			}
+			if got := rejectedIds(result.rejected); reflect.DeepEqual(got, test.rejected) == false {
+				t.Errorf("rejected %v, expected %v", got, test.rejected)
+			}
+			if got := messageIds(d.queued); reflect.DeepEqual(got, test.queued) == false {
+				t.Errorf("queued %v, expected %v", got, test.queued)
+			}
+		})
+	}
+}
+
+func TestDestinationCountsRejections(t *testing.T) {
+
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(documentsRejected.WithLabelValues("test", reason))
+	}
+	reasons := []string{rejectReasonDocumentId, rejectReasonDocumentNumber, rejectReasonTolerant, rejectReasonUnidentified}
+	before := make(map[string]float64)
+	for _, reason := range reasons {
+		before[reason] = rejected(reason)
+	}
+
+	// an unknown id is bisected, the isolated document is only counted once
+	d, _ := testDestination(t, "rejectid:x,ok,reject,reject")
+	for _, id := range []string{"a", "b", "c", "d"} {
+		_ = d.buffer(testMessage(id))
+	}
+	if _, err := d.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for _, reason := range reasons {
+		expected := 0.0
+		if reason == rejectReasonUnidentified {
+			expected = 1
+		}
+		if got := rejected(reason) - before[reason]; got != expected {
+			t.Errorf("expected %0.0f %s rejections, got %0.0f", expected, reason, got)
+		}
+	}
+}
+
+func TestDestinationRetainsFailedBatch(t *testing.T) {
+
+	d, fake := testDestination(t, "http:500")
+	for _, id := range []string{"a", "b"} {
+		_ = d.buffer(testMessage(id))
+	}
+
+	if _, err := d.flush(); err == nil {
+		t.Fatalf("expected the first flush to fail")
+	}
+
+	// the documents are still buffered so the next flush adds them
+	result, err := d.flush()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if got := messageIds(result.accepted); reflect.DeepEqual(got, []string{"a", "b"}) == false {
+		t.Errorf("accepted %v, expected [a b]", got)
+	}
+	if got := fake.Added(); reflect.DeepEqual(got, [][]string{{"a", "b"}}) == false {
+		t.Errorf("added %v, expected [[a b]]", got)
+	}
+}
+
+func TestDestinationSupersedes(t *testing.T) {
+
+	d, fake := testDestination(t, "")
+
+	older := testMessage("a")
+	older.FirstSent = 1
+	newer := testMessage("a")
+	newer.FirstSent = 2
+
+	_ = d.buffer(newer)
+	_ = d.buffer(testMessage("b"))
+	_ = d.buffer(older)
+
+	result, err := d.flush()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// only the newer copy is sent but both are done with
+	if got := fake.Added(); reflect.DeepEqual(got, [][]string{{"a", "b"}}) == false {
+		t.Errorf("added %v, expected [[a b]]", got)
+	}
+	if len(result.accepted) != 3 || result.accepted[0].FirstSent != 2 || result.accepted[2].FirstSent != 1 {
+		t.Errorf("expected the newer copy, b and the older copy to be accepted, got %v", messageIds(result.accepted))
+	}
+}
+
+func TestParseFakeScript(t *testing.T) {
+
+	tests := []struct {
+		script string
+		valid  bool
+	}{
+		{"", true},
+		{"ok,faildoc:3,rejectid:x,rejectdoc:1,reject,errors:a;b,conflict:c,http:503,commit:500,panic", true},
+		{"faildoc:0", false},
+		{"rejectdoc:-1", false},
+		{"faildoc:x", false},
+		{"http:42", false},
+		{"rejectid", false},
+		{"explode", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseFakeScript(test.script)
+		if (err == nil) != test.valid {
+			t.Errorf("script [%s]: expected valid %t, got error %v", test.script, test.valid, err)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// the document processor chain. Each document we add is passed through the configured processors, in order,
+// before it is buffered. The chain is defined by a JSON configuration file, for example:
+//
+// [
+//   { "type": "constant",  "field": "pipeline_version", "value": "${PIPELINE_VERSION}" },
+//   { "type": "timestamp", "field": "indexed_at" },
+//   { "type": "attribute", "field": "source_queue", "attribute": "source", "required": true },
+//   { "type": "drop",      "fields": [ "internal_notes" ] },
+//   { "type": "rename",    "from": "title_t", "to": "title_tsearch" },
+//   { "type": "cap",       "fields": [ "subject_a" ], "max": 100 }
+// ]
+//
+// Constant values may refer to environment variables. A processor that fails rejects the document
+//
+
+// DocumentProcessor - something that changes a document before it is sent to SOLR
+type DocumentProcessor interface {
+	Name() string                                        // the processor name (for logging)
+	Process(doc *Document, message awssqs.Message) error // process the document, the message is where it came from
+}
+
+// the configuration for a single processor, the fields used depend on the type
+type processorConfig struct {
+	Type      string   `json:"type"`      // the processor type
+	Field     string   `json:"field"`     // the field to add
+	Fields    []string `json:"fields"`    // the fields to drop or cap
+	Value     string   `json:"value"`     // the constant value
+	Attribute string   `json:"attribute"` // the message attribute
+	Required  bool     `json:"required"`  // is it an error if the attribute is missing
+	Format    string   `json:"format"`    // the timestamp format (Go layout)
+	Overwrite bool     `json:"overwrite"` // replace any existing values of the field
+	From      string   `json:"from"`      // the field to rename
+	To        string   `json:"to"`        // the new field name
+	Max       int      `json:"max"`       // the maximum number of values
+}
+
+// the destination name reported when a processor rejects a document
+var processorDestination = "processor"
+
+// the SOLR date format
+var solrTimestampFormat = "2006-01-02T15:04:05Z"
+
+// the processor chain shared by all the workers
+var documentProcessors = make([]DocumentProcessor, 0)
+
+// load the document processor chain from the configuration file, if there is one
+func createDocumentProcessors(config *ServiceConfig) error {
+
+	if len(config.ProcessorConfig) == 0 {
+		return nil
+	}
+
+	content, err := os.ReadFile(config.ProcessorConfig)
+	if err != nil {
+		return err
+	}
+
+	var configs []processorConfig
+	err = json.Unmarshal(content, &configs)
+	if err != nil {
+		return fmt.Errorf("%s: %s", config.ProcessorConfig, err.Error())
+	}
+
+	for ix, pc := range configs {
+		processor, err := newDocumentProcessor(pc)
+		if err != nil {
+			return fmt.Errorf("%s: processor %d: %s", config.ProcessorConfig, ix+1, err.Error())
+		}
+		log.Printf("INFO: document processor %d: %s", ix+1, processor.Name())
+		documentProcessors = append(documentProcessors, processor)
+	}
+
+	return nil
+}
+
+func newDocumentProcessor(pc processorConfig) (DocumentProcessor, error) {
+
+	switch pc.Type {
+
+	case "constant":
+		if len(pc.Field) == 0 {
+			return nil, fmt.Errorf("constant processor requires a field")
+		}
+		return &constantProcessor{field: pc.Field, value: os.ExpandEnv(pc.Value), overwrite: pc.Overwrite}, nil
+
+	case "timestamp":
+		if len(pc.Field) == 0 {
+			return nil, fmt.Errorf("timestamp processor requires a field")
+		}
+		format := pc.Format
+		if len(format) == 0 {
+			format = solrTimestampFormat
+		}
+		return &timestampProcessor{field: pc.Field, format: format, overwrite: pc.Overwrite}, nil
+
+	case "attribute":
+		if len(pc.Field) == 0 || len(pc.Attribute) == 0 {
+			return nil, fmt.Errorf("attribute processor requires a field and an attribute")
+		}
+		return &attributeProcessor{field: pc.Field, attribute: pc.Attribute, required: pc.Required, overwrite: pc.Overwrite}, nil
+
+	case "drop":
+		if len(pc.Fields) == 0 {
+			return nil, fmt.Errorf("drop processor requires fields")
+		}
+		return &dropProcessor{fields: pc.Fields}, nil
+
+	case "rename":
+		if len(pc.From) == 0 || len(pc.To) == 0 {
+			return nil, fmt.Errorf("rename processor requires from and to")
+		}
+		return &renameProcessor{from: pc.From, to: pc.To}, nil
+
+	case "cap":
+		if len(pc.Fields) == 0 || pc.Max < 1 {
+			return nil, fmt.Errorf("cap processor requires fields and a max of at least 1")
+		}
+		return &capProcessor{fields: pc.Fields, max: pc.Max}, nil
+	}
+
+	return nil, fmt.Errorf("unknown processor type [%s]", pc.Type)
+}
+
+// pass the message payload through the processor chain, returns the new payload. Only documents we add
+// are processed
+func processDocument(config *ServiceConfig, message awssqs.Message) ([]byte, error) {
+
+	if len(documentProcessors) == 0 || messageMode(config, message) != "add" {
+		return message.Payload, nil
+	}
+
+	doc, err := parseDocument(config.SolrFormat, message.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for ix, p := range documentProcessors {
+		err = p.Process(doc, message)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d (%s) failed: %s", ix+1, p.Name(), err.Error())
+		}
+	}
+
+	return doc.Encode(), nil
+}
+
+// set a field value, replacing any existing values if required
+func setField(doc *Document, field string, value string, overwrite bool) {
+	if overwrite == true {
+		doc.Remove(field)
+	}
+	doc.Add(field, value)
+}
+
+// adds a constant value
+type constantProcessor struct {
+	field     string
+	value     string
+	overwrite bool
+}
+
+func (p *constantProcessor) Name() string {
+	return fmt.Sprintf("constant %s = [%s]", p.field, p.value)
+}
+
+func (p *constantProcessor) Process(doc *Document, message awssqs.Message) error {
+	setField(doc, p.field, p.value, p.overwrite)
+	return nil
+}
+
+// adds the time the document was processed
+type timestampProcessor struct {
+	field     string
+	format    string
+	overwrite bool
+}
+
+func (p *timestampProcessor) Name() string {
+	return fmt.Sprintf("timestamp %s", p.field)
+}
+
+func (p *timestampProcessor) Process(doc *Document, message awssqs.Message) error {
+	setField(doc, p.field, time.Now().UTC().Format(p.format), p.overwrite)
+	return nil
+}
+
+// adds the value of a message attribute
+type attributeProcessor struct {
+	field     string
+	attribute string
+	required  bool
+	overwrite bool
+}
+
+func (p *attributeProcessor) Name() string {
+	return fmt.Sprintf("attribute %s = attribute %s", p.field, p.attribute)
+}
+
+func (p *attributeProcessor) Process(doc *Document, message awssqs.Message) error {
+
+	value, found := message.GetAttribute(p.attribute)
+	if found == false {
+		if p.required == true {
+			return fmt.Errorf("message has no %s attribute", p.attribute)
+		}
+		return nil
+	}
+
+	setField(doc, p.field, value, p.overwrite)
+	return nil
+}
+
+// removes fields
+type dropProcessor struct {
+	fields []string
+}
+
+func (p *dropProcessor) Name() string {
+	return fmt.Sprintf("drop %v", p.fields)
+}
+
+func (p *dropProcessor) Process(doc *Document, message awssqs.Message) error {
+	for _, f := range p.fields {
+		doc.Remove(f)
+	}
+	return nil
+}
+
+// renames a field
+type renameProcessor struct {
+	from string
+	to   string
+}
+
+func (p *renameProcessor) Name() string {
+	return fmt.Sprintf("rename %s to %s", p.from, p.to)
+}
+
+func (p *renameProcessor) Process(doc *Document, message awssqs.Message) error {
+	doc.Rename(p.from, p.to)
+	return nil
+}
+
+// limits the number of values of multi-valued fields
+type capProcessor struct {
+	fields []string
+	max    int
+}
+
+func (p *capProcessor) Name() string {
+	return fmt.Sprintf("cap %v at %d", p.fields, p.max)
+}
+
+func (p *capProcessor) Process(doc *Document, message awssqs.Message) error {
+
+	for _, f := range p.fields {
+		if removed := doc.Cap(f, p.max); removed != 0 {
+			id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+			log.Printf("INFO: id %s: removed %d values of %s", id, removed, f)
+		}
+	}
+	return nil
+}
+
+//
+// end of file
+//
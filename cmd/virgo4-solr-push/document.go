@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// Document - a single document as a list of fields so that it can be changed before it is sent to SOLR. A
+// multi-valued field has one entry per value. Anything we do not understand (sub-documents, nested JSON
+// objects) is kept as it was
+type Document struct {
+	Fields []DocumentField
+
+	format    string            // the format the document came from (xml or json)
+	start     xml.StartElement  // the XML doc element
+	inherited []xml.Attr        // the XML namespace declarations of the elements wrapping the doc element
+	prefixes  map[string]string // the XML namespace prefixes, by namespace
+	arrays    map[string]bool   // the JSON fields that were arrays
+}
+
+// the namespace of the xml prefix, it never needs declaring
+var xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// DocumentField - a single field value
+type DocumentField struct {
+	Name  string // the field name, empty for sub-documents
+	Value string // the field value as text
+
+	attrs []xml.Attr // any other XML field attributes
+	raw   []byte     // the original encoding if we keep it (sub-documents and JSON values)
+}
+
+// parse a document payload in the specified format
+func parseDocument(format string, payload []byte) (*Document, error) {
+
+	if format == "json" {
+		return parseJsonDocument(payload)
+	}
+	return parseXmlDocument(payload)
+}
+
+func parseXmlDocument(payload []byte) (*Document, error) {
+
+	doc := &Document{format: "xml", prefixes: map[string]string{xmlNamespace: "xml"}}
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	depth := 0
+	docDepth := -1
+	var field *DocumentField
+	var childStart int64
+
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no document in payload")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+
+		case xml.StartElement:
+			depth++
+
+			// the decoder gives us the namespace of a prefixed attribute, we need the prefix to write it
+			if err = doc.namespaces(t, docDepth == -1 && t.Name.Local != "doc"); err != nil {
+				return nil, err
+			}
+
+			switch {
+			case docDepth == -1 && t.Name.Local == "doc":
+				docDepth = depth
+				doc.start = t.Copy()
+			case depth == docDepth+1:
+				childStart = offset
+				if t.Name.Local == "field" {
+					field = &DocumentField{}
+					for _, a := range t.Attr {
+						if a.Name.Local == "name" {
+							field.Name = a.Value
+						} else {
+							field.attrs = append(field.attrs, a)
+						}
+					}
+				}
+			}
+
+		case xml.CharData:
+			if field != nil && depth == docDepth+1 {
+				field.Value += string(t)
+			}
+
+		case xml.EndElement:
+			if depth == docDepth+1 {
+				if field != nil {
+					doc.Fields = append(doc.Fields, *field)
+					field = nil
+				} else {
+					doc.Fields = append(doc.Fields, DocumentField{raw: append([]byte{}, payload[childStart:decoder.InputOffset()]...)})
+				}
+			}
+			if depth == docDepth {
+				return doc, nil
+			}
+			depth--
+		}
+	}
+}
+
+// remember the namespace prefixes an element declares and check it only uses prefixes we know about. The
+// declarations made outside the document are kept so the document can be written on its own
+func (d *Document) namespaces(element xml.StartElement, outside bool) error {
+
+	for _, a := range element.Attr {
+		if a.Name.Space == "xmlns" {
+			d.prefixes[a.Value] = a.Name.Local
+			if outside == true {
+				d.inherited = append(d.inherited, a)
+			}
+		}
+	}
+
+	for _, a := range element.Attr {
+		if _, found := d.prefixes[a.Name.Space]; len(a.Name.Space) != 0 && a.Name.Space != "xmlns" && found == false {
+			return fmt.Errorf("attribute %s:%s has an undeclared namespace prefix", a.Name.Space, a.Name.Local)
+		}
+	}
+	return nil
+}
+
+func parseJsonDocument(payload []byte) (*Document, error) {
+
+	doc := &Document{format: "json", arrays: make(map[string]bool)}
+
+	// we read the fields one at a time to keep them in order
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("payload is not a document object")
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := key.(string)
+
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+
+		values := []json.RawMessage{raw}
+		if len(raw) != 0 && raw[0] == '[' {
+			doc.arrays[name] = true
+			if err = json.Unmarshal(raw, &values); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, v := range values {
+			doc.Fields = append(doc.Fields, DocumentField{Name: name, Value: jsonText(v), raw: append([]byte{}, v...)})
+		}
+	}
+
+	return doc, nil
+}
+
+// the text of a JSON value, strings are unquoted
+func jsonText(raw json.RawMessage) string {
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// Values returns the values of the named field
+func (d *Document) Values(name string) []string {
+
+	values := make([]string, 0)
+	for _, f := range d.Fields {
+		if f.Name == name {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Add adds a value to the named field
+func (d *Document) Add(name string, value string) {
+	d.Fields = append(d.Fields, DocumentField{Name: name, Value: value})
+}
+
+// Remove removes the named field, returns the number of values removed
+func (d *Document) Remove(name string) int {
+	return d.Cap(name, 0)
+}
+
+// Rename renames a field, any existing values of the new field are kept
+func (d *Document) Rename(from string, to string) {
+
+	for ix := range d.Fields {
+		if d.Fields[ix].Name == from {
+			d.Fields[ix].Name = to
+		}
+	}
+	if d.arrays[from] == true {
+		d.arrays[to] = true
+	}
+}
+
+// Cap removes the values of the named field beyond the maximum, returns the number of values removed
+func (d *Document) Cap(name string, max int) int {
+
+	count := 0
+	kept := make([]DocumentField, 0, len(d.Fields))
+	for _, f := range d.Fields {
+		if f.Name == name {
+			count++
+			if count > max {
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+
+	d.Fields = kept
+	if count > max {
+		return count - max
+	}
+	return 0
+}
+
+// Encode returns the document in the format it came from
+func (d *Document) Encode() []byte {
+
+	if d.format == "json" {
+		return d.encodeJson()
+	}
+	return d.encodeXml()
+}
+
+func (d *Document) encodeXml() []byte {
+
+	var buf bytes.Buffer
+	// the doc element may declare the same prefixes as its wrappers
+	attrs := make([]xml.Attr, 0, len(d.inherited)+len(d.start.Attr))
+	for _, a := range d.inherited {
+		redeclared := false
+		for _, own := range d.start.Attr {
+			redeclared = redeclared || own.Name == a.Name
+		}
+		if redeclared == false {
+			attrs = append(attrs, a)
+		}
+	}
+
+	buf.WriteString("<doc")
+	d.writeXmlAttrs(&buf, append(attrs, d.start.Attr...))
+	buf.WriteString(">")
+
+	for _, f := range d.Fields {
+		if f.raw != nil {
+			buf.Write(f.raw)
+			continue
+		}
+		buf.WriteString("<field")
+		d.writeXmlAttrs(&buf, append([]xml.Attr{{Name: xml.Name{Local: "name"}, Value: f.Name}}, f.attrs...))
+		buf.WriteString(">")
+		_ = xml.EscapeText(&buf, []byte(f.Value))
+		buf.WriteString("</field>")
+	}
+
+	buf.WriteString("</doc>")
+	return buf.Bytes()
+}
+
+// write the attributes, a namespaced one is written with the prefix it was declared with
+func (d *Document) writeXmlAttrs(buf *bytes.Buffer, attrs []xml.Attr) {
+
+	for _, a := range attrs {
+		buf.WriteString(" ")
+		switch a.Name.Space {
+		case "":
+		case "xmlns":
+			buf.WriteString("xmlns:")
+		default:
+			buf.WriteString(d.prefixes[a.Name.Space])
+			buf.WriteString(":")
+		}
+		buf.WriteString(a.Name.Local)
+		buf.WriteString(`="`)
+		_ = xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+}
+
+func (d *Document) encodeJson() []byte {
+
+	// the values of each field are written together, in the order the fields first appear
+	names := make([]string, 0)
+	values := make(map[string][][]byte)
+	for _, f := range d.Fields {
+		raw := f.raw
+		if raw == nil {
+			raw, _ = json.Marshal(f.Value)
+		}
+		if _, found := values[f.Name]; found == false {
+			names = append(names, f.Name)
+		}
+		values[f.Name] = append(values[f.Name], raw)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for ix, name := range names {
+		if ix != 0 {
+			buf.WriteString(",")
+		}
+		quoted, _ := json.Marshal(name)
+		buf.Write(quoted)
+		buf.WriteString(":")
+
+		v := values[name]
+		if len(v) == 1 && d.arrays[name] == false {
+			buf.Write(v[0])
+			continue
+		}
+		buf.WriteString("[")
+		buf.Write(bytes.Join(v, []byte(",")))
+		buf.WriteString("]")
+	}
+	buf.WriteString("}")
+	return buf.Bytes()
+}
+
+//
+// end of file
+//
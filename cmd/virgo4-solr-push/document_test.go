@@ -0,0 +1,220 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestXmlDocumentRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected string // empty if it is the payload
+	}{
+		{name: "fields", payload: `<doc><field name="id">a</field><field name="title">x &amp; y &lt;z&gt;</field></doc>`},
+		{name: "field attributes", payload: `<doc boost="2"><field name="id">a</field><field name="tags" update="add">t</field></doc>`},
+		{name: "sub-documents kept as they are", payload: `<doc><field name="id">a</field><doc>  <field name="id">a-1</field> </doc></doc>`},
+		{name: "wrapper and whitespace removed",
+			payload:  "<add>\n  <doc>\n    <field name=\"id\">a</field>\n  </doc>\n</add>",
+			expected: `<doc><field name="id">a</field></doc>`},
+		{name: "namespaced attribute",
+			payload: `<doc xmlns:v="urn:virgo"><field name="id" v:source="sirsi">a</field></doc>`},
+		{name: "xml attribute", payload: `<doc><field name="title" xml:lang="fr">café</field></doc>`},
+		{name: "namespace declared by the wrapper",
+			payload:  `<add xmlns:v="urn:virgo"><doc><field name="id" v:source="sirsi">a</field></doc></add>`,
+			expected: `<doc xmlns:v="urn:virgo"><field name="id" v:source="sirsi">a</field></doc>`},
+		{name: "namespace declared by the wrapper and the doc",
+			payload:  `<add xmlns:v="urn:virgo"><doc xmlns:v="urn:virgo"><field name="id" v:source="sirsi">a</field></doc></add>`,
+			expected: `<doc xmlns:v="urn:virgo"><field name="id" v:source="sirsi">a</field></doc>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			doc, err := parseDocument("xml", []byte(test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			expected := test.expected
+			if len(expected) == 0 {
+				expected = test.payload
+			}
+			if got := string(doc.Encode()); got != expected {
+				t.Errorf("expected %s, got %s", expected, got)
+			}
+		})
+	}
+
+	for _, payload := range []string{`<doc><field name="id" v:source="sirsi">a</field></doc>`, `<add></add>`, `<doc>`} {
+		if _, err := parseDocument("xml", []byte(payload)); err == nil {
+			t.Errorf("expected %s to be rejected", payload)
+		}
+	}
+}
+
+func TestJsonDocumentRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected string // empty if it is the payload
+	}{
+		{name: "fields in order", payload: `{"id":"a","count":3,"flag":true,"title":"café"}`, expected: `{"id":"a","count":3,"flag":true,"title":"café"}`},
+		{name: "arrays", payload: `{"id":"a","tags":["x","y"],"one":["z"]}`},
+		{name: "nested objects kept as they are", payload: `{"id":"a","_childDocuments_":[{"id":"a-1"}],"title":{"set":"t"}}`},
+		{name: "whitespace removed", payload: "{ \"id\" : \"a\" ,\n \"tags\" : [ 1 , 2 ] }", expected: `{"id":"a","tags":[1,2]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			doc, err := parseDocument("json", []byte(test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			expected := test.expected
+			if len(expected) == 0 {
+				expected = test.payload
+			}
+			if got := string(doc.Encode()); got != expected {
+				t.Errorf("expected %s, got %s", expected, got)
+			}
+		})
+	}
+
+	for _, payload := range []string{`["a"]`, `{"id":`, ``} {
+		if _, err := parseDocument("json", []byte(payload)); err == nil {
+			t.Errorf("expected %s to be rejected", payload)
+		}
+	}
+}
+
+// run a single processor over each format of the same document, the processor must give the same result
+func testProcessor(t *testing.T, pc processorConfig, message awssqs.Message, xmlIn string, xmlOut string, jsonIn string, jsonOut string) {
+
+	t.Helper()
+	processor, err := newDocumentProcessor(pc)
+	if err != nil {
+		t.Fatalf("bad processor: %s", err.Error())
+	}
+
+	for _, f := range []struct{ format, in, out string }{{"xml", xmlIn, xmlOut}, {"json", jsonIn, jsonOut}} {
+		doc, err := parseDocument(f.format, []byte(f.in))
+		if err != nil {
+			t.Fatalf("bad %s document: %s", f.format, err.Error())
+		}
+		err = processor.Process(doc, message)
+		switch {
+		case len(f.out) == 0 && err == nil:
+			t.Errorf("%s: expected the processor to fail", f.format)
+		case len(f.out) != 0 && err != nil:
+			t.Errorf("%s: unexpected error: %s", f.format, err.Error())
+		case len(f.out) != 0 && string(doc.Encode()) != f.out:
+			t.Errorf("%s: expected %s, got %s", f.format, f.out, doc.Encode())
+		}
+	}
+}
+
+func TestConstantProcessor(t *testing.T) {
+
+	t.Setenv("TEST_PIPELINE_VERSION", "v2")
+	pc := processorConfig{Type: "constant", Field: "pipeline", Value: "${TEST_PIPELINE_VERSION}"}
+	testProcessor(t, pc, testMessage("a"),
+		`<doc><field name="pipeline">v1</field></doc>`, `<doc><field name="pipeline">v1</field><field name="pipeline">v2</field></doc>`,
+		`{"pipeline":"v1"}`, `{"pipeline":["v1","v2"]}`)
+
+	pc.Overwrite = true
+	testProcessor(t, pc, testMessage("a"),
+		`<doc><field name="pipeline">v1</field></doc>`, `<doc><field name="pipeline">v2</field></doc>`,
+		`{"pipeline":"v1"}`, `{"pipeline":"v2"}`)
+}
+
+func TestTimestampProcessor(t *testing.T) {
+
+	processor, err := newDocumentProcessor(processorConfig{Type: "timestamp", Field: "indexed_at"})
+	if err != nil {
+		t.Fatalf("bad processor: %s", err.Error())
+	}
+
+	doc, _ := parseDocument("xml", []byte(`<doc><field name="id">a</field></doc>`))
+	before := time.Now().UTC().Truncate(time.Second)
+	_ = processor.Process(doc, testMessage("a"))
+
+	values := doc.Values("indexed_at")
+	if len(values) != 1 {
+		t.Fatalf("expected a single timestamp, got %v", values)
+	}
+	stamp, err := time.Parse(solrTimestampFormat, values[0])
+	if err != nil || stamp.Before(before) == true || stamp.After(time.Now().UTC()) == true {
+		t.Errorf("expected the current time in the SOLR format, got %s", values[0])
+	}
+}
+
+func TestAttributeProcessor(t *testing.T) {
+
+	message := testMessage("a")
+	message.Attribs = append(message.Attribs, awssqs.Attribute{Name: "source", Value: "sirsi"})
+
+	pc := processorConfig{Type: "attribute", Field: "source_f", Attribute: "source"}
+	testProcessor(t, pc, message,
+		`<doc></doc>`, `<doc><field name="source_f">sirsi</field></doc>`,
+		`{}`, `{"source_f":"sirsi"}`)
+
+	// a missing attribute is ignored unless it is required
+	testProcessor(t, pc, testMessage("a"), `<doc></doc>`, `<doc></doc>`, `{}`, `{}`)
+	pc.Required = true
+	testProcessor(t, pc, testMessage("a"), `<doc></doc>`, "", `{}`, "")
+}
+
+func TestDropProcessor(t *testing.T) {
+
+	pc := processorConfig{Type: "drop", Fields: []string{"notes", "tmp"}}
+	testProcessor(t, pc, testMessage("a"),
+		`<doc><field name="id">a</field><field name="notes">x</field><field name="notes">y</field><field name="tmp">z</field></doc>`,
+		`<doc><field name="id">a</field></doc>`,
+		`{"id":"a","notes":["x","y"],"tmp":"z"}`, `{"id":"a"}`)
+}
+
+func TestRenameProcessor(t *testing.T) {
+
+	pc := processorConfig{Type: "rename", From: "title_t", To: "title_tsearch"}
+	testProcessor(t, pc, testMessage("a"),
+		`<doc><field name="title_t">x</field><field name="title_tsearch">y</field></doc>`,
+		`<doc><field name="title_tsearch">x</field><field name="title_tsearch">y</field></doc>`,
+		`{"title_t":["x"],"id":"a"}`, `{"title_tsearch":["x"],"id":"a"}`)
+}
+
+func TestCapProcessor(t *testing.T) {
+
+	pc := processorConfig{Type: "cap", Fields: []string{"subject"}, Max: 2}
+	testProcessor(t, pc, testMessage("a"),
+		`<doc><field name="subject">x</field><field name="id">a</field><field name="subject">y</field><field name="subject">z</field></doc>`,
+		`<doc><field name="subject">x</field><field name="id">a</field><field name="subject">y</field></doc>`,
+		`{"subject":["x","y","z"],"id":"a"}`, `{"subject":["x","y"],"id":"a"}`)
+}
+
+func TestNewDocumentProcessor(t *testing.T) {
+
+	invalid := []processorConfig{
+		{Type: "constant"},
+		{Type: "timestamp"},
+		{Type: "attribute", Field: "f"},
+		{Type: "drop"},
+		{Type: "rename", From: "f"},
+		{Type: "cap", Fields: []string{"f"}},
+		{Type: "explode"},
+	}
+
+	for _, pc := range invalid {
+		if _, err := newDocumentProcessor(pc); err == nil {
+			t.Errorf("expected %+v to be rejected", pc)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// attributes added to messages copied to the failure queue
+var AttributeKeySolrDestination = "solr-destination"
+var AttributeKeySolrError = "solr-error"
+var AttributeKeySolrFailedDoc = "solr-failed-doc"
+var AttributeKeySolrWorker = "solr-worker"
+var AttributeKeySolrFailedTime = "solr-failed-time"
+
+// SQS limits the total message size so keep the error text to something sensible
+var maxErrorAttributeSize = 1024
+
+// copy a message rejected by SOLR to the failure queue along with the failure details and then remove it
+// from the inbound queue so it is not reprocessed. If no failure queue is configured, the message is left
+// on the inbound queue as before.
+func rejectMessage(workerId int, aws awssqs.AWS_SQS, inQueue awssqs.QueueHandle, failQueue awssqs.QueueHandle, message awssqs.Message, rejection Rejection) error {
+
+	// no failure queue configured
+	if len(failQueue) == 0 {
+		return nil
+	}
+
+	solrError := truncateError(rejection.Reason, maxErrorAttributeSize)
+
+	// make a copy of the message and add the failure details
+	failed := message.ContentClone()
+	failed.Attribs = append(make(awssqs.Attributes, 0, len(message.Attribs)+5), message.Attribs...)
+	failed.Attribs = append(failed.Attribs, awssqs.Attribute{Name: AttributeKeySolrDestination, Value: rejection.Destination})
+	failed.Attribs = append(failed.Attribs, awssqs.Attribute{Name: AttributeKeySolrError, Value: solrError})
+	failed.Attribs = append(failed.Attribs, awssqs.Attribute{Name: AttributeKeySolrFailedDoc, Value: rejection.FailedDoc})
+	failed.Attribs = append(failed.Attribs, awssqs.Attribute{Name: AttributeKeySolrWorker, Value: fmt.Sprintf("%d", workerId)})
+	failed.Attribs = append(failed.Attribs, awssqs.Attribute{Name: AttributeKeySolrFailedTime, Value: time.Now().UTC().Format(time.RFC3339)})
+
+	// empty attribute values are not allowed by SQS
+	for ix := range failed.Attribs {
+		if len(failed.Attribs[ix].Value) == 0 {
+			failed.Attribs[ix].Value = "unknown"
+		}
+	}
+
+	messages := []awssqs.Message{*failed}
+	opStatus, err := aws.BatchMessagePut(failQueue, messages)
+	if err != nil {
+		if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			return err
+		}
+
+		// try again...
+		err = aws.MessagePutRetry(failQueue, messages, opStatus, 3)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("worker %d: INFO moved id/doc number %s (rejected by %s) to the failure queue", workerId, rejection.FailedDoc, rejection.Destination)
+
+	// and remove it from the inbound queue
+	return blockDelete(workerId, aws, inQueue, []awssqs.Message{message})
+}
+
+// truncate the error text without splitting a character, SQS only accepts valid UTF-8 attribute values
+func truncateError(text string, size int) string {
+
+	text = strings.ToValidUTF8(text, "?")
+	if len(text) <= size {
+		return text
+	}
+
+	for size > 0 && utf8.RuneStart(text[size]) == false {
+		size--
+	}
+	return text[:size]
+}
+
+//
+// end of file
+//
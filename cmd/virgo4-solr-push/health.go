@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// the health of the service as reported by the health and readiness endpoints. The workers and the poll loop
+// report their state here and the HTTP handlers take a snapshot of it
+type healthTracker struct {
+	sync.Mutex
+	livenessWindow time.Duration         // a worker that has made no progress in this time is not live
+	source         sourceHealth          // the state of the message source
+	workers        map[int]*workerHealth // the state of each worker
+}
+
+// the state of the message source
+type sourceHealth struct {
+	Healthy     bool      `json:"healthy"`         // did the last receive succeed
+	LastReceive time.Time `json:"last_receive"`    // when the last receive completed
+	Error       string    `json:"error,omitempty"` // the last receive error
+}
+
+// the state of a single worker
+type workerHealth struct {
+	Id           int                           `json:"id"`
+	Live         bool                          `json:"live"`                // has the worker made progress within the liveness window
+	LastProgress time.Time                     `json:"last_progress"`       // when the worker last went around its loop
+	State        string                        `json:"state,omitempty"`     // what the worker is waiting for (connecting, flushing or limited)
+	WaitUntil    time.Time                     `json:"wait_until,omitzero"` // when the worker will retry, it is live until then
+	Destinations map[string]*destinationHealth `json:"destinations"`        // the state of each destination
+}
+
+// the state of a single destination as seen by a worker
+type destinationHealth struct {
+	Required bool      `json:"required"`
+	Alive    bool      `json:"alive"`           // did the last SOLR ping succeed
+	LastPing time.Time `json:"last_ping"`       // when the last SOLR ping completed
+	Error    string    `json:"error,omitempty"` // the last ping error
+}
+
+// the body returned by the health endpoints
+type healthReport struct {
+	Healthy bool           `json:"healthy"`
+	Source  sourceHealth   `json:"source"`
+	Workers []workerHealth `json:"workers"`
+}
+
+// our service health
+var serviceHealth = &healthTracker{livenessWindow: 60 * time.Second, workers: make(map[int]*workerHealth)}
+
+func (h *healthTracker) configure(config *ServiceConfig) {
+	h.Lock()
+	defer h.Unlock()
+	h.livenessWindow = time.Duration(config.LivenessWindow) * time.Second
+}
+
+// record the outcome of a message source receive
+func (h *healthTracker) received(err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.source.LastReceive = time.Now()
+	h.source.Healthy = err == nil
+	h.source.Error = ""
+	if err != nil {
+		h.source.Error = err.Error()
+	}
+}
+
+// record that a worker has gone around its loop
+func (h *healthTracker) progress(workerId int) {
+	h.Lock()
+	defer h.Unlock()
+
+	w := h.worker(workerId)
+	w.LastProgress = time.Now()
+	w.State = ""
+	w.WaitUntil = time.Time{}
+}
+
+// record that a worker is waiting before it retries something, it is live while it waits
+func (h *healthTracker) waiting(workerId int, state string, delay time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	w := h.worker(workerId)
+	w.LastProgress = time.Now()
+	w.State = state
+	w.WaitUntil = w.LastProgress.Add(delay)
+}
+
+// record the outcome of a SOLR ping from a worker
+func (h *healthTracker) pinged(workerId int, name string, required bool, err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	dh := &destinationHealth{Required: required, Alive: err == nil, LastPing: time.Now()}
+	if err != nil {
+		dh.Error = err.Error()
+	}
+	h.worker(workerId).Destinations[name] = dh
+}
+
+// the liveness report, we are live if every worker has made progress recently
+func (h *healthTracker) live() healthReport {
+	h.Lock()
+	defer h.Unlock()
+
+	report := h.report()
+	report.Healthy = true
+	for _, w := range report.Workers {
+		if w.Live == false {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// the readiness report, we are ready if the last receive succeeded and the last ping of every required
+// destination succeeded and its circuit breaker is closed
+func (h *healthTracker) ready() healthReport {
+	h.Lock()
+	defer h.Unlock()
+
+	report := h.report()
+	report.Healthy = h.source.Healthy && len(report.Workers) != 0
+	for _, w := range report.Workers {
+		for _, d := range w.Destinations {
+			if d.Required == true && d.Alive == false {
+				report.Healthy = false
+			}
+		}
+	}
+	return report
+}
+
+// take a snapshot of the current state, the caller must hold the lock
+func (h *healthTracker) report() healthReport {
+
+	report := healthReport{Source: h.source, Workers: make([]workerHealth, 0, len(h.workers))}
+	for _, w := range h.workers {
+		snapshot := *w
+		last := w.LastProgress
+		if w.WaitUntil.After(last) == true {
+			last = w.WaitUntil
+		}
+		snapshot.Live = time.Since(last) <= h.livenessWindow
+		snapshot.Destinations = make(map[string]*destinationHealth, len(w.Destinations))
+		for name, d := range w.Destinations {
+			dh := *d
+			// the last ping may have succeeded but SOLR has failed since, the breaker probes it until it answers
+			if circuitBreakerFor(name).isOpen() == true {
+				dh.Alive = false
+				dh.Error = "circuit breaker open"
+			}
+			snapshot.Destinations[name] = &dh
+		}
+		report.Workers = append(report.Workers, snapshot)
+	}
+	sort.Slice(report.Workers, func(i, j int) bool { return report.Workers[i].Id < report.Workers[j].Id })
+	return report
+}
+
+// get the state for a worker, creating it if necessary. The caller must hold the lock
+func (h *healthTracker) worker(workerId int) *workerHealth {
+
+	w, found := h.workers[workerId]
+	if found == false {
+		w = &workerHealth{Id: workerId, LastProgress: time.Now(), Destinations: make(map[string]*destinationHealth)}
+		h.workers[workerId] = w
+	}
+	return w
+}
+
+//
+// end of file
+//
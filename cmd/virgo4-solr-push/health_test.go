@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthWaiting(t *testing.T) {
+
+	h := &healthTracker{livenessWindow: time.Minute, workers: make(map[int]*workerHealth)}
+	h.progress(1)
+	h.waiting(2, "connecting", 10*time.Minute)
+
+	// neither has made progress within the window but worker 2 is still waiting to retry
+	for _, w := range h.workers {
+		w.LastProgress = w.LastProgress.Add(-5 * time.Minute)
+	}
+
+	report := h.live()
+	if report.Healthy == true {
+		t.Errorf("expected the service not to be live")
+	}
+	if report.Workers[0].Live == true || report.Workers[1].Live == false || report.Workers[1].State != "connecting" {
+		t.Errorf("expected only the waiting worker to be live, got %+v", report.Workers)
+	}
+
+	// progress clears the waiting state
+	h.progress(2)
+	if h.workers[2].State != "" || h.workers[2].WaitUntil.IsZero() == false {
+		t.Errorf("expected the waiting state to be cleared")
+	}
+}
+
+//
+// end of file
+//
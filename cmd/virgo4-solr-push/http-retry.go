@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HttpStatusError - a SOLR request returned an unexpected HTTP status
+type HttpStatusError struct {
+	StatusCode int           // the HTTP status
+	RetryAfter time.Duration // any Retry-After the server asked for
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("request returns HTTP %d", e.StatusCode)
+}
+
+// how we retry failed HTTP requests
+type retryPolicy struct {
+	attempts int           // the maximum number of attempts
+	base     time.Duration // the delay before the first retry
+	max      time.Duration // the maximum delay between attempts
+	statuses map[int]bool  // the HTTP status codes that can be retried
+}
+
+// create the retry policy from the configuration
+func newRetryPolicy(config ServiceConfig) retryPolicy {
+
+	policy := retryPolicy{
+		attempts: config.HttpRetries,
+		base:     time.Duration(config.HttpRetryBase) * time.Millisecond,
+		max:      time.Duration(config.HttpRetryMax) * time.Millisecond,
+		statuses: make(map[int]bool),
+	}
+
+	for _, code := range config.HttpRetryStatus {
+		policy.statuses[code] = true
+	}
+
+	// we always make at least one attempt
+	if policy.attempts < 1 {
+		policy.attempts = 1
+	}
+
+	return policy
+}
+
+// how long to wait before the specified retry (1 is the first). The delay doubles with each attempt up to the
+// maximum and is jittered so the workers do not retry in lock step. If the server asked us to wait longer we
+// do as we are told, but never longer than the maximum
+func (p retryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+
+	delay := p.base
+	for i := 1; i < retry && delay < p.max; i++ {
+		delay *= 2
+	}
+	if delay > p.max {
+		delay = p.max
+	}
+
+	// somewhere between half and all of the delay
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	if retryAfter > p.max {
+		retryAfter = p.max
+	}
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// can a request that failed with this error be retried
+func (p retryPolicy) canRetry(err error) bool {
+
+	// the server returned a status that might succeed later
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) == true {
+		return p.statuses[statusErr.StatusCode]
+	}
+
+	// timeouts
+	if isTimeout(err) == true {
+		return true
+	}
+
+	// name resolution failures
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) == true {
+		return dnsErr.IsTimeout == true || dnsErr.IsTemporary == true || dnsErr.IsNotFound == true
+	}
+
+	// connection failures
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED,
+		syscall.EPIPE, syscall.ENETDOWN, syscall.ENETUNREACH, syscall.EHOSTUNREACH} {
+		if errors.Is(err, errno) == true {
+			return true
+		}
+	}
+
+	// the server closed the connection on us
+	if errors.Is(err, io.EOF) == true || errors.Is(err, io.ErrUnexpectedEOF) == true {
+		return true
+	}
+
+	return false
+}
+
+// did the request time out
+func isTimeout(err error) bool {
+
+	if errors.Is(err, context.DeadlineExceeded) == true || errors.Is(err, syscall.ETIMEDOUT) == true {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) == true && urlErr.Timeout() == true {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) == true && netErr.Timeout() == true
+}
+
+// parse a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(header string) time.Duration {
+
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	when, err := http.ParseTime(header)
+	if err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+//
+// end of file
+//
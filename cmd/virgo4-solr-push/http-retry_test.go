@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+
+	policy := retryPolicy{attempts: 3, base: 100 * time.Millisecond, max: time.Second}
+
+	tests := []struct {
+		name       string
+		retry      int
+		retryAfter time.Duration
+		min        time.Duration
+		max        time.Duration
+	}{
+		{name: "first retry", retry: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{name: "doubles", retry: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{name: "capped", retry: 10, min: 500 * time.Millisecond, max: time.Second},
+		{name: "retry after", retry: 1, retryAfter: 800 * time.Millisecond, min: 800 * time.Millisecond, max: 800 * time.Millisecond},
+		{name: "retry after capped", retry: 1, retryAfter: time.Hour, min: time.Second, max: time.Second},
+	}
+
+	for _, test := range tests {
+		delay := policy.delay(test.retry, test.retryAfter)
+		if delay < test.min || delay > test.max {
+			t.Errorf("%s: expected a delay between %s and %s, got %s", test.name, test.min, test.max, delay)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// start our HTTP server for the metrics and health endpoints, a port of zero disables it
+func startHttpServer(config *ServiceConfig) {
+
+	if config.ServicePort == 0 {
+		log.Printf("INFO: service port is zero, HTTP endpoints are DISABLED")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, serviceHealth.live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, serviceHealth.ready())
+	})
+
+	address := fmt.Sprintf(":%d", config.ServicePort)
+	log.Printf("INFO: starting HTTP server on %s", address)
+
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		fatalIfError(err)
+	}()
+}
+
+// write a health report, unhealthy reports are returned as service unavailable
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+
+	status := http.StatusOK
+	if report.Healthy == false {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("ERROR: writing health report (%s)", err.Error())
+	}
+}
+
+//
+// end of file
+//
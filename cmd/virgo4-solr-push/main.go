@@ -2,8 +2,12 @@ package main
 
 import (
 	"github.com/antchfx/xmlquery"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
@@ -17,32 +21,112 @@ func main() {
 	// Get config params
 	cfg := LoadConfiguration()
 
-	// load our AWS_SQS helper object
-	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
-	fatalIfError(err)
+	// in some cases, the xmlquery library is not thread safe so configure it not to
+	// use the cache feature which is one of the bits that is not thread safe.
+	xmlquery.DisableSelectorCache = true
 
-	// get the queue handle from the queue name
-	inQueueHandle, err := aws.QueueHandle(cfg.InQueueName)
+	// we need the uniqueKey field to find document ids in the payloads
+	if len(cfg.SolrUniqueKey) == 0 {
+		cfg.SolrUniqueKey = discoverUniqueKey(cfg)
+	}
+
+	// create our message source
+	source, err := NewMessageSource(cfg)
 	fatalIfError(err)
 
 	// create the record channel
 	inboundMessageChan := make(chan awssqs.Message, cfg.WorkerQueueSize)
+	registerInboundQueueGauge(inboundMessageChan)
+
+	// the circuit breakers, the batch sizers, the request limiters, the document processors and the memory
+	// budget are shared by all the workers
+	createCircuitBreakers(cfg)
+	createBatchSizers(cfg, inboundMessageChan)
+	createRequestLimiters(cfg)
+	configureMemoryBudget(cfg)
+	err = createDocumentProcessors(cfg)
+	fatalIfError(err)
 
-	// in some cases, the xmlquery library is not thread safe so configure it not to
-	// use the cache feature which is one of the bits that is not thread safe.
-	xmlquery.DisableSelectorCache = true
+	// start the metrics and health endpoints
+	serviceHealth.configure(cfg)
+	startHttpServer(cfg)
 
 	// start workers here
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
 	for w := 1; w <= cfg.Workers; w++ {
-		go worker(w, cfg, aws, inQueueHandle, inboundMessageChan)
+		workers.Add(1)
+		go superviseWorker(w, cfg, source, inboundMessageChan, stop, &workers)
 	}
 
+	// we shut down when we are asked to or when the message source is exhausted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	exhausted := make(chan struct{})
+	go poll(cfg, source, inboundMessageChan, stop, exhausted)
+
+	select {
+	case sig := <-signals:
+		log.Printf("INFO: received %s, shutting down", sig)
+	case <-exhausted:
+		log.Printf("INFO: message source is exhausted, shutting down")
+	}
+
+	// stop polling and let the workers drain, add and commit whatever they have
+	close(stop)
+	finished := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		log.Printf("INFO: shutdown complete")
+		os.Exit(0)
+	case <-time.After(time.Duration(cfg.ShutdownDeadline) * time.Second):
+		log.Printf("ERROR: shutdown deadline exceeded, exiting with work outstanding")
+		os.Exit(1)
+	}
+}
+
+// receive messages from the source and hand them to the workers until we are told to stop or the source
+// is exhausted. While any required SOLR destination is unavailable we leave the messages where they are
+func poll(cfg *ServiceConfig, source MessageSource, inboundMessageChan chan<- awssqs.Message, stop <-chan struct{}, exhausted chan<- struct{}) {
+
+	paused := false
 	for {
 
+		// wait for SOLR to become available
+		if requiredBreakersOpen(cfg) == true {
+			if paused == false {
+				log.Printf("INFO: SOLR is unavailable, pausing message polling")
+				paused = true
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(breakerCheckTime):
+			}
+			continue
+		}
+
+		if paused == true {
+			log.Printf("INFO: SOLR is available, resuming message polling")
+			paused = false
+		}
+
 		//log.Printf("Waiting for messages...")
 
 		// wait for a batch of messages
-		messages, err := aws.BatchMessageGet(inQueueHandle, awssqs.MAX_SQS_BLOCK_COUNT, time.Duration(cfg.PollTimeOut)*time.Second)
+		messages, err := source.Receive()
+		if err == io.EOF {
+			serviceHealth.received(nil)
+			close(exhausted)
+			return
+		}
+
+		serviceHealth.received(err)
 		if err != nil {
 			log.Printf("ERROR: during message get (%s), sleeping and retrying", err.Error())
 
@@ -58,14 +142,33 @@ func main() {
 		if sz != 0 {
 
 			//log.Printf( "Received %d messages", sz )
+			messagesReceived.Add(float64(sz))
 
+			// anything we do not hand over is left on the queue to be redelivered
 			for _, m := range messages {
-				inboundMessageChan <- m
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				select {
+				case inboundMessageChan <- m:
+				case <-stop:
+					return
+				}
 			}
 
 		} else {
 			log.Printf("No messages available")
 		}
+
+		// have we been told to stop
+		select {
+		case <-stop:
+			return
+		default:
+		}
 	}
 }
 
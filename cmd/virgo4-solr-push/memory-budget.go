@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+)
+
+// the memory used by the documents buffered to the required destinations by all the workers. Once the budget is exceeded the workers stop
+// taking messages and send what they have buffered, taking more once enough of it has been sent. The peak is
+// the budget plus the last message each worker took (buffered to each of its destinations)
+type memoryBudget struct {
+	sync.Mutex
+	limit int64 // the budget in bytes, zero for no limit
+	used  int64 // the bytes currently buffered
+	over  bool  // we exceeded the budget and have not yet dropped back below the resume level
+}
+
+// once over budget, the fraction of the budget we must drop below before we are within it again. This stops
+// the workers taking one message at a time when the buffers are close to the budget
+var budgetResume = 0.9
+
+// the budget shared by all the workers
+var bufferBudget = &memoryBudget{}
+
+// set the budget from the configuration
+func configureMemoryBudget(config *ServiceConfig) {
+	bufferBudget.Lock()
+	defer bufferBudget.Unlock()
+	bufferBudget.limit = int64(config.MemoryBudget) * 1024 * 1024
+}
+
+// account for a buffered document
+func (b *memoryBudget) reserve(size int) {
+	b.Lock()
+	defer b.Unlock()
+	b.used += int64(size)
+	bufferedBytes.Set(float64(b.used))
+}
+
+// the buffered documents have been sent or discarded
+func (b *memoryBudget) release(size int) {
+	b.Lock()
+	defer b.Unlock()
+	b.used -= int64(size)
+	bufferedBytes.Set(float64(b.used))
+}
+
+// have the workers buffered more than the budget
+func (b *memoryBudget) exceeded() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case b.limit == 0:
+		b.over = false
+	case b.used >= b.limit:
+		b.over = true
+	case float64(b.used) < budgetResume*float64(b.limit):
+		b.over = false
+	}
+	return b.over
+}
+
+//
+// end of file
+//
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+
+	b := &memoryBudget{limit: 100}
+
+	steps := []struct {
+		change   int
+		exceeded bool
+	}{
+		{change: 50, exceeded: false},
+		{change: 50, exceeded: true},
+		{change: -5, exceeded: true}, // not yet below the resume level
+		{change: -10, exceeded: false},
+		{change: 5, exceeded: false},
+	}
+
+	for ix, step := range steps {
+		if step.change > 0 {
+			b.reserve(step.change)
+		} else {
+			b.release(-step.change)
+		}
+		if got := b.exceeded(); got != step.exceeded {
+			t.Errorf("step %d: with %d bytes used expected exceeded %t, got %t", ix+1, b.used, step.exceeded, got)
+		}
+	}
+}
+
+func TestOptionalDestinationNotBudgeted(t *testing.T) {
+
+	for _, required := range []bool{true, false} {
+
+		s, _ := testSolr(t, func(c *ServiceConfig) {
+			c.DestinationRequired = required
+		})
+
+		before := bufferBudget.used
+		bufferDocs(t, s, "a")
+		reserved := bufferBudget.used - before
+		s.ClearBuffer()
+
+		switch {
+		case required == true && reserved == 0:
+			t.Errorf("expected a required destination to reserve from the budget")
+		case required == false && reserved != 0:
+			t.Errorf("expected an optional destination not to reserve from the budget, got %d bytes", reserved)
+		}
+		if bufferBudget.used != before {
+			t.Errorf("expected the buffer to be released, %d bytes are still reserved", bufferBudget.used-before)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// MessageSource - our inbound message source interface
+type MessageSource interface {
+	Receive() ([]awssqs.Message, error)          // receive a batch of messages (io.EOF when the source is exhausted)
+	Acknowledge(int, []awssqs.Message) error     // the messages were processed successfully and can be removed
+	Reject(int, awssqs.Message, Rejection) error // the message was rejected by SOLR
+}
+
+// Rejection - the details of a document rejected by SOLR
+type Rejection struct {
+	Destination string // the name of the destination that rejected the document
+	FailedDoc   string // the failing id/doc number reported by SOLR
+	Reason      string // the error message reported by SOLR
+}
+
+// NewMessageSource - Initialize our message source
+func NewMessageSource(config *ServiceConfig) (MessageSource, error) {
+
+	switch config.SourceType {
+	case "sqs":
+		return newSqsSource(config)
+	case "file":
+		return newFileSource(config)
+	}
+
+	return nil, fmt.Errorf("unsupported message source [%s]", config.SourceType)
+}
+
+//
+// end of file
+//
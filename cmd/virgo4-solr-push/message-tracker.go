@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// tracks the inbound messages for a worker so that each one is acknowledged (or rejected) only once every
+// required destination has finished with it. The acknowledgements are made in the background so the worker
+// does not wait for them
+type messageTracker struct {
+	workerId     int                                      // used for logging
+	source       MessageSource                            // where the messages came from
+	pending      map[awssqs.ReceiptHandle]*trackedMessage // the messages we are waiting on
+	acknowledge  chan []awssqs.Message                    // the messages waiting to be acknowledged
+	acknowledged chan struct{}                            // closed once all the acknowledgements are made
+}
+
+// a single tracked message
+type trackedMessage struct {
+	message     awssqs.Message // the message
+	outstanding int            // the number of required destinations that have not finished with the message
+	rejection   *Rejection     // the first rejection reported
+	abandoned   bool           // one or more destinations gave up on the message
+}
+
+// create a new message tracker
+func newMessageTracker(workerId int, source MessageSource) *messageTracker {
+
+	t := &messageTracker{workerId: workerId, source: source, pending: make(map[awssqs.ReceiptHandle]*trackedMessage)}
+	t.acknowledge = make(chan []awssqs.Message, 16)
+	t.acknowledged = make(chan struct{})
+	go t.acknowledgeLoop()
+	return t
+}
+
+// acknowledge the messages as they are settled. If this fails the messages are redelivered later
+func (t *messageTracker) acknowledgeLoop() {
+
+	defer close(t.acknowledged)
+	for messages := range t.acknowledge {
+		err := t.source.Acknowledge(t.workerId, messages)
+		if err != nil {
+			log.Printf("worker %d: ERROR acknowledge failed, messages will be redelivered (%s)", t.workerId, err.Error())
+		}
+	}
+}
+
+// wait for any outstanding acknowledgements, the tracker cannot be used afterwards
+func (t *messageTracker) close() {
+	close(t.acknowledge)
+	<-t.acknowledged
+}
+
+// start tracking a message that is being sent to the specified number of required destinations
+func (t *messageTracker) track(message awssqs.Message, required int) {
+	t.pending[message.ReceiptHandle] = &trackedMessage{message: message, outstanding: required}
+}
+
+// update the tracked messages with the result of a flush from one of the required destinations and
+// acknowledge or reject any messages that are complete
+func (t *messageTracker) update(result flushResult) error {
+
+	complete := make([]*trackedMessage, 0, len(result.accepted)+len(result.rejected)+len(result.abandoned))
+
+	for _, m := range result.accepted {
+		if tm := t.done(m); tm != nil {
+			complete = append(complete, tm)
+		}
+	}
+
+	for _, r := range result.rejected {
+		if tm := t.done(r.message); tm != nil {
+			complete = append(complete, tm)
+		}
+		if tracked, found := t.pending[r.message.ReceiptHandle]; found == true && tracked.rejection == nil {
+			rejection := r.rejection
+			tracked.rejection = &rejection
+		}
+	}
+
+	for _, m := range result.abandoned {
+		if tm := t.done(m); tm != nil {
+			complete = append(complete, tm)
+		}
+		if tracked, found := t.pending[m.ReceiptHandle]; found == true {
+			tracked.abandoned = true
+		}
+	}
+
+	// now settle the complete ones, a failed rejection does not stop us settling the others
+	var errs []error
+	accepted := make([]awssqs.Message, 0, len(complete))
+	for _, tm := range complete {
+
+		delete(t.pending, tm.message.ReceiptHandle)
+
+		switch {
+		// rejected by at least one of the destinations
+		case tm.rejection != nil:
+			err := t.source.Reject(t.workerId, tm.message, *tm.rejection)
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+		// leave it to be redelivered
+		case tm.abandoned == true:
+			id, _ := tm.message.GetAttribute(awssqs.AttributeKeyRecordId)
+			log.Printf("worker %d: WARNING abandoned id %s, it will be redelivered", t.workerId, id)
+
+		default:
+			accepted = append(accepted, tm.message)
+		}
+	}
+
+	if len(accepted) != 0 {
+		t.acknowledge <- accepted
+	}
+	return errors.Join(errs...)
+}
+
+// mark a message as done by one destination, returns the tracked message if it is now complete. The tracked
+// message stays in the pending map until it is settled so that rejections can be recorded against it
+func (t *messageTracker) done(message awssqs.Message) *trackedMessage {
+
+	tracked, found := t.pending[message.ReceiptHandle]
+	if found == false {
+		log.Printf("worker %d: WARNING untracked message %s", t.workerId, message.ReceiptHandle)
+		return nil
+	}
+
+	tracked.outstanding--
+	if tracked.outstanding == 0 {
+		return tracked
+	}
+	return nil
+}
+
+//
+// end of file
+//
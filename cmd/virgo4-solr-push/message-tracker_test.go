@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a message source that records what happens to the messages, rejecting the specified ids fails
+type testSource struct {
+	sync.Mutex
+	acknowledged []string
+	rejected     []string
+	failReject   map[string]bool
+}
+
+func (s *testSource) Receive() ([]awssqs.Message, error) {
+	return nil, nil
+}
+
+func (s *testSource) Acknowledge(workerId int, messages []awssqs.Message) error {
+	s.Lock()
+	defer s.Unlock()
+	s.acknowledged = append(s.acknowledged, messageIds(messages)...)
+	return nil
+}
+
+func (s *testSource) Reject(workerId int, message awssqs.Message, rejection Rejection) error {
+	s.Lock()
+	defer s.Unlock()
+	id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+	if s.failReject[id] == true {
+		return fmt.Errorf("cannot reject %s", id)
+	}
+	s.rejected = append(s.rejected, id)
+	return nil
+}
+
+// a tracked message, the id is also the receipt handle
+func trackedTestMessage(t *messageTracker, id string, required int) awssqs.Message {
+	m := testMessage(id)
+	m.ReceiptHandle = awssqs.ReceiptHandle(id)
+	t.track(m, required)
+	return m
+}
+
+func TestMessageTrackerUpdate(t *testing.T) {
+
+	source := &testSource{failReject: map[string]bool{"a": true}}
+	tracker := newMessageTracker(1, source)
+
+	a := trackedTestMessage(tracker, "a", 1)
+	b := trackedTestMessage(tracker, "b", 1)
+	c := trackedTestMessage(tracker, "c", 1)
+	d := trackedTestMessage(tracker, "d", 2)
+
+	// a failed rejection does not stop the others being settled
+	err := tracker.update(flushResult{
+		accepted: []awssqs.Message{c, d},
+		rejected: []rejectedMessage{{message: a}, {message: b}},
+	})
+	tracker.close()
+
+	if err == nil {
+		t.Errorf("expected the failed rejection to be reported")
+	}
+	if reflect.DeepEqual(source.rejected, []string{"b"}) == false {
+		t.Errorf("expected b to be rejected, got %v", source.rejected)
+	}
+
+	// d is still waiting on the other destination
+	if reflect.DeepEqual(source.acknowledged, []string{"c"}) == false {
+		t.Errorf("expected c to be acknowledged, got %v", source.acknowledged)
+	}
+	if _, found := tracker.pending[d.ReceiptHandle]; found == false || len(tracker.pending) != 1 {
+		t.Errorf("expected only d to be pending, got %d", len(tracker.pending))
+	}
+}
+
+//
+// end of file
+//
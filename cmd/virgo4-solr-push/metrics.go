@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// all our metrics are prefixed with this
+var metricsNamespace = "virgo4_solr_push"
+
+// the reasons reported for rejected documents
+var rejectReasonDocumentNumber = "document_number" // SOLR reported the failing document number
+var rejectReasonDocumentId = "document_id"         // SOLR reported the failing document id
+var rejectReasonTolerant = "tolerant"              // the tolerant update chain reported the failing document
+var rejectReasonUnidentified = "unidentified"      // SOLR did not identify the document, we found it by splitting the batch
+var rejectReasonInvalidPayload = "invalid_payload" // the payload failed pre-flight validation and was never sent
+var rejectReasonProcessor = "processor"            // a document processor failed and the document was never sent
+
+var messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "messages_received_total",
+	Help:      "The number of messages received from the message source",
+})
+
+var documentsAdded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "documents_added_total",
+	Help:      "The number of documents added to SOLR",
+}, []string{"destination"})
+
+var documentsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "documents_rejected_total",
+	Help:      "The number of documents rejected by SOLR",
+}, []string{"destination", "reason"})
+
+var documentsStale = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "documents_stale_total",
+	Help:      "The number of documents SOLR ignored because a newer version was already indexed",
+}, []string{"destination"})
+
+var documentsSuperseded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "documents_superseded_total",
+	Help:      "The number of documents not sent to SOLR because a newer copy was pending",
+}, []string{"destination"})
+
+var documentsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "documents_dropped_total",
+	Help:      "The number of documents not sent to an optional destination because it was too far behind",
+}, []string{"destination"})
+
+var idMismatches = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "id_mismatches_total",
+	Help:      "The number of messages whose id attribute does not match the id in the payload",
+})
+
+var sqsDeletes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "sqs_deletes_total",
+	Help:      "The number of inbound queue message deletes",
+}, []string{"result"})
+
+var addLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_add_duration_seconds",
+	Help:      "The time taken to add a batch of documents to SOLR",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{"destination"})
+
+var commitLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_commit_duration_seconds",
+	Help:      "The time taken to commit SOLR",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{"destination"})
+
+var batchDocuments = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_add_batch_documents",
+	Help:      "The number of documents in each batch sent to SOLR",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+}, []string{"destination"})
+
+var batchBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_add_batch_bytes",
+	Help:      "The size of each batch sent to SOLR",
+	Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+}, []string{"destination"})
+
+var compressedBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_request_compressed_bytes",
+	Help:      "The compressed size of each update request sent to SOLR",
+	Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+}, []string{"destination"})
+
+var uncompressedBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_request_uncompressed_bytes",
+	Help:      "The uncompressed size of each compressed update request sent to SOLR",
+	Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+}, []string{"destination"})
+
+var solrQTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_qtime_seconds",
+	Help:      "The QTime reported by SOLR for update requests",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"destination"})
+
+var pendingDocuments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "pending_documents",
+	Help:      "The number of documents buffered but not yet added to SOLR",
+}, []string{"worker", "destination"})
+
+var blockCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_block_count",
+	Help:      "The number of documents that triggers an add to SOLR, adjusted by adaptive batching",
+}, []string{"destination"})
+
+var concurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_request_limit",
+	Help:      "The number of concurrent update and commit requests allowed by all the workers, zero for no limit",
+}, []string{"destination"})
+
+var requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_requests_in_flight",
+	Help:      "The number of update and commit requests being made by all the workers",
+}, []string{"destination"})
+
+var inFlightBatches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "in_flight_batches",
+	Help:      "The number of batches being added to SOLR while the worker buffers the next",
+}, []string{"worker", "destination"})
+
+var bufferedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "buffered_bytes",
+	Help:      "The size of the update requests buffered by all the workers",
+})
+
+var circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "solr_circuit_open",
+	Help:      "Whether the circuit breaker for a destination is open (1) or closed (0)",
+}, []string{"destination"})
+
+// the inbound channel is created in main so this is registered once we have it
+func registerInboundQueueGauge(inbound chan awssqs.Message) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inbound_queue_messages",
+		Help:      "The number of messages waiting in the inbound channel for a worker",
+	}, func() float64 {
+		return float64(len(inbound))
+	})
+}
+
+//
+// end of file
+//
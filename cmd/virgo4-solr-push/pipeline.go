@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a required destination as seen by a worker. The worker buffers the next batch while earlier batches are
+// added to SOLR in the background. Each batch is buffered to its own lane (a destination with its own SOLR
+// connection) and added by a separate goroutine which reports back when it is done. Everything else belongs
+// to the worker. If no batches may be in flight, there is a single lane and the worker adds each batch itself
+type pipeline struct {
+	name        string                    // the destination name
+	lanes       []*destination            // all of the lanes
+	active      *destination              // the lane buffering the next batch
+	idle        []*destination            // the lanes with nothing to add
+	failed      []*destination            // the lanes whose add failed, oldest first. They are added again before anything else
+	inFlight    int                       // the number of batches being added
+	maxInFlight int                       // the maximum number of batches being added at once
+	held        map[*destination][]string // the ids of the documents in each batch we are waiting on
+	sending     map[string]int            // the ids of the documents in flight or failed, a newer copy waits for them
+	stalled     bool                      // the next batch is ready but cannot be sent yet
+	backoff     *backoff                  // consecutive add and commit failures, shared by the lanes
+	breaker     *circuitBreaker           // shared with the other workers using this destination
+	flights     chan<- flight             // where the lanes report when they are done
+	workerId    int                       // used for logging
+}
+
+// a batch added in the background
+type flight struct {
+	pipe   *pipeline    // the pipeline the batch belongs to
+	lane   *destination // the lane that added it
+	result flushResult  // the outcome
+	err    error        // any error, the remaining documents are still buffered to the lane
+}
+
+// create the lanes for a required destination, retrying until SOLR is available or we are told to stop (returns nil)
+func connectPipeline(workerId int, config *ServiceConfig, dest DestinationConfig, flights chan<- flight, stop <-chan struct{}) *pipeline {
+
+	p := &pipeline{name: dest.Name, maxInFlight: config.InFlightBatches, flights: flights, workerId: workerId}
+	p.held = make(map[*destination][]string)
+	p.sending = make(map[string]int)
+
+	// one lane for each batch in flight and one for the batch we are buffering
+	for len(p.lanes) <= p.maxInFlight {
+		lane := connectDestination(workerId, config, dest, stop)
+		if lane == nil {
+			return nil
+		}
+		p.lanes = append(p.lanes, lane)
+	}
+
+	p.backoff = p.lanes[0].backoff
+	p.breaker = p.lanes[0].breaker
+	for _, lane := range p.lanes {
+		lane.backoff = p.backoff
+	}
+
+	p.active = p.lanes[0]
+	p.idle = append(p.idle, p.lanes[1:]...)
+	return p
+}
+
+// buffer a message to the next batch
+func (p *pipeline) buffer(message awssqs.Message) error {
+	return p.active.buffer(message)
+}
+
+// are we waiting after a failure or is SOLR not available
+func (p *pipeline) paused() bool {
+	return p.backoff.waiting() == true || p.breaker.isOpen() == true
+}
+
+// add the next batch to SOLR if it is time to do so, commit if it is time and check SOLR is still there.
+// Failed batches are added again first
+func (p *pipeline) sendIfTime(tracker *messageTracker) {
+
+	p.stalled = false
+
+	// still waiting after a failure or SOLR is not available
+	if p.paused() == true {
+		return
+	}
+
+	// whatever happens, check SOLR is still there
+	defer func() {
+		p.active.pingIfTime()
+	}()
+
+	for len(p.failed) != 0 && p.inFlight < p.maxInFlight {
+		lane := p.failed[0]
+		p.failed = p.failed[1:]
+		p.launch(lane)
+	}
+
+	// check to see if it is time to 'add' these to SOLR
+	if p.active.solr.IsTimeToAdd() == true {
+		id := p.waitingOn()
+		switch {
+		case p.maxInFlight == 0:
+			if p.addNow(tracker) == false {
+				return
+			}
+		case p.inFlight >= p.maxInFlight || len(p.idle) == 0:
+			p.stalled = true
+		case len(id) != 0:
+			log.Printf("worker %d: INFO %s waiting for the batch containing id %s before sending the next one", p.workerId, p.name, id)
+			p.stalled = true
+		default:
+			lane := p.active
+			p.active = p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			p.hold(lane)
+			p.launch(lane)
+		}
+	}
+
+	// is it time to send a commit to SOLR
+	for _, lane := range p.owned() {
+		err := lane.commitIfTime()
+		if err != nil {
+			lane.failed("commit", err)
+			return
+		}
+	}
+	if len(p.failed) == 0 {
+		p.backoff.succeeded()
+	}
+}
+
+// the id of a document in the next batch that is still being sent in an earlier one, if there is one. Keeping
+// the copies of a document in order means the newest one is always added last
+func (p *pipeline) waitingOn() string {
+
+	for _, m := range p.active.queued {
+		id, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+		if p.sending[id] != 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// remember the ids in a batch until we are done with it
+func (p *pipeline) hold(lane *destination) {
+
+	held := make([]string, 0, len(lane.queued))
+	for _, m := range lane.queued {
+		id, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+		p.sending[id]++
+		held = append(held, id)
+	}
+	p.held[lane] = held
+}
+
+// we are done with the ids in a batch
+func (p *pipeline) release(lane *destination) {
+
+	for _, id := range p.held[lane] {
+		p.sending[id]--
+		if p.sending[id] == 0 {
+			delete(p.sending, id)
+		}
+	}
+	delete(p.held, lane)
+}
+
+// add the batch buffered to a lane in the background
+func (p *pipeline) launch(lane *destination) {
+
+	p.inFlight++
+	inFlightBatches.WithLabelValues(strconv.Itoa(p.workerId), p.name).Set(float64(p.inFlight))
+
+	go func() {
+		var result flushResult
+		var err error
+		clean := runRecovered(p.workerId, fmt.Sprintf("%s add", p.name), func() {
+			result, err = lane.flush()
+		})
+
+		// we cannot trust the state of the lane, give up on everything it has
+		if clean == false {
+			result = flushResult{abandoned: lane.abandon()}
+			err = nil
+		}
+
+		p.flights <- flight{pipe: p, lane: lane, result: result, err: err}
+	}()
+}
+
+// add the active batch and wait for it, used when no batches may be in flight. If it failed the lane keeps
+// the remaining documents and adds them again once we have waited a while. Returns true if it succeeded
+func (p *pipeline) addNow(tracker *messageTracker) bool {
+
+	lane := p.active
+	var result flushResult
+	var err error
+	clean := runRecovered(p.workerId, fmt.Sprintf("%s add", p.name), func() {
+		result, err = lane.flush()
+	})
+
+	// we cannot trust the state of the lane, give up on everything it has
+	if clean == false {
+		result = flushResult{abandoned: lane.abandon()}
+		err = nil
+	}
+
+	uerr := tracker.update(result)
+	if uerr != nil {
+		log.Printf("worker %d: ERROR %s update failed, messages will be redelivered (%s)", p.workerId, p.name, uerr.Error())
+	}
+
+	if err != nil {
+		lane.failed("add", err)
+		return false
+	}
+	return true
+}
+
+// a batch has been added, delete or reject the messages that all the required destinations are done with.
+// If it failed, the lane keeps the remaining documents and adds them again once we have waited a while
+func (p *pipeline) land(f flight, tracker *messageTracker) {
+
+	p.inFlight--
+	inFlightBatches.WithLabelValues(strconv.Itoa(p.workerId), p.name).Set(float64(p.inFlight))
+
+	err := tracker.update(f.result)
+	if err != nil {
+		log.Printf("worker %d: ERROR %s update failed, messages will be redelivered (%s)", p.workerId, p.name, err.Error())
+	}
+
+	if f.err != nil {
+		f.lane.failed("add", f.err)
+		p.failed = append(p.failed, f.lane)
+		return
+	}
+
+	p.release(f.lane)
+	p.idle = append(p.idle, f.lane)
+}
+
+// give up on everything the lanes have buffered, used when the worker exits once nothing is in flight. Anything
+// not yet deleted is redelivered later
+func (p *pipeline) abandon() {
+
+	for _, lane := range p.lanes {
+		lane.abandon()
+	}
+}
+
+// the lanes that are not adding anything, only these can be used by the worker
+func (p *pipeline) owned() []*destination {
+
+	owned := make([]*destination, 0, len(p.lanes))
+	owned = append(owned, p.failed...)
+	owned = append(owned, p.active)
+	return append(owned, p.idle...)
+}
+
+// add any remaining documents and commit, used during shutdown once nothing is in flight
+func (p *pipeline) flushAndCommit(tracker *messageTracker) {
+
+	for _, lane := range p.owned() {
+		flushAndCommit(lane, tracker)
+	}
+	p.failed = p.failed[:0]
+}
+
+//
+// end of file
+//
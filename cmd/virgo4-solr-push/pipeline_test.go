@@ -0,0 +1,269 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a pipeline with a single lane using the fake SOLR implementation, nothing is added in the background
+func testPipeline(t *testing.T, script string) (*pipeline, *solrFake) {
+
+	lane, fake := testDestination(t, script)
+	fake.Config.SolrBlockCount = 2
+
+	p := &pipeline{name: lane.name, lanes: []*destination{lane}, active: lane, workerId: 1}
+	p.held = make(map[*destination][]string)
+	p.sending = make(map[string]int)
+	p.backoff = lane.backoff
+	p.breaker = lane.breaker
+	return p, fake
+}
+
+func TestPipelineAddsWithoutBatchesInFlight(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		script       string
+		acknowledged []string
+		queued       []string
+	}{
+		{name: "added", script: "ok", acknowledged: []string{"a", "b"}, queued: []string{}},
+		{name: "failed", script: "http:503", acknowledged: nil, queued: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			p, _ := testPipeline(t, test.script)
+			source := &testSource{}
+			tracker := newMessageTracker(1, source)
+
+			for _, id := range []string{"a", "b"} {
+				m := testMessage(id)
+				m.ReceiptHandle = awssqs.ReceiptHandle(id)
+				tracker.track(m, 1)
+				if err := p.buffer(m); err != nil {
+					t.Fatalf("buffer failed: %s", err.Error())
+				}
+			}
+
+			p.sendIfTime(tracker)
+			tracker.close()
+
+			if p.inFlight != 0 {
+				t.Errorf("expected nothing in flight, got %d", p.inFlight)
+			}
+			if reflect.DeepEqual(source.acknowledged, test.acknowledged) == false {
+				t.Errorf("expected %v to be acknowledged, got %v", test.acknowledged, source.acknowledged)
+			}
+			if got := messageIds(p.active.queued); reflect.DeepEqual(got, test.queued) == false {
+				t.Errorf("expected %v to be queued, got %v", test.queued, got)
+			}
+		})
+	}
+}
+
+// a pipeline that may have batches in flight, each lane uses the fake SOLR implementation with its own
+// script. Every add waits until the test lets it go, the lanes are in the order they are first used
+func testInFlightPipeline(t *testing.T, maxInFlight int, scripts ...string) (*pipeline, map[*destination]*solrFake, chan flight) {
+
+	flights := make(chan flight, maxInFlight)
+	p := &pipeline{name: "test", maxInFlight: maxInFlight, flights: flights, workerId: 1}
+	p.held = make(map[*destination][]string)
+	p.sending = make(map[string]int)
+
+	fakes := make(map[*destination]*solrFake)
+	for ix := 0; ix <= maxInFlight; ix++ {
+		script := ""
+		if ix < len(scripts) {
+			script = scripts[ix]
+		}
+		lane, fake := testDestination(t, script)
+		fake.Config.SolrBlockCount = 2
+		fake.gate = make(chan struct{}, 1)
+		fakes[lane] = fake
+		p.lanes = append(p.lanes, lane)
+	}
+
+	// the lanes are taken from the end of the idle list, failed batches are sent again straight away
+	p.backoff = newBackoff(0, 0)
+	p.breaker = p.lanes[0].breaker
+	p.active = p.lanes[0]
+	for ix := len(p.lanes) - 1; ix > 0; ix-- {
+		p.idle = append(p.idle, p.lanes[ix])
+	}
+	for _, lane := range p.lanes {
+		lane.backoff = p.backoff
+	}
+	return p, fakes, flights
+}
+
+// buffer a tracked message for each id, the receipt handle is the id and the copy
+func bufferTracked(t *testing.T, p *pipeline, tracker *messageTracker, copy string, ids ...string) {
+
+	for _, id := range ids {
+		m := testMessage(id)
+		m.ReceiptHandle = awssqs.ReceiptHandle(id + copy)
+		tracker.track(m, 1)
+		if err := p.buffer(m); err != nil {
+			t.Fatalf("buffer failed: %s", err.Error())
+		}
+	}
+}
+
+// let the add in flight on the lane finish and land it
+func landLane(t *testing.T, p *pipeline, fakes map[*destination]*solrFake, flights chan flight, lane *destination, tracker *messageTracker) {
+
+	fakes[lane].gate <- struct{}{}
+	select {
+	case f := <-flights:
+		if f.lane != lane {
+			t.Fatalf("expected the batch on lane %p to land, got lane %p", lane, f.lane)
+		}
+		p.land(f, tracker)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the batch did not land")
+	}
+}
+
+// wait for the ids to be acknowledged, they are acknowledged in the background
+func waitForAcknowledged(t *testing.T, source *testSource, expected ...string) {
+
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) == true; time.Sleep(5 * time.Millisecond) {
+		source.Lock()
+		got = append([]string{}, source.acknowledged...)
+		source.Unlock()
+		if reflect.DeepEqual(got, expected) == true {
+			return
+		}
+	}
+	t.Fatalf("expected %v to be acknowledged, got %v", expected, got)
+}
+
+func TestPipelineOutOfOrderCompletion(t *testing.T) {
+
+	p, fakes, flights := testInFlightPipeline(t, 2)
+	source := &testSource{}
+	tracker := newMessageTracker(1, source)
+	defer tracker.close()
+
+	// two batches in flight and a third being buffered
+	first := p.active
+	bufferTracked(t, p, tracker, "", "a", "b")
+	p.sendIfTime(tracker)
+	second := p.active
+	bufferTracked(t, p, tracker, "", "c", "d")
+	p.sendIfTime(tracker)
+	if p.inFlight != 2 || first == second || len(p.idle) != 0 {
+		t.Fatalf("expected two batches in flight on separate lanes, got %d", p.inFlight)
+	}
+
+	// the second finishes first
+	landLane(t, p, fakes, flights, second, tracker)
+	waitForAcknowledged(t, source, "c", "d")
+	landLane(t, p, fakes, flights, first, tracker)
+	waitForAcknowledged(t, source, "c", "d", "a", "b")
+	if p.inFlight != 0 || len(p.idle) != 2 || len(p.sending) != 0 {
+		t.Errorf("expected every lane to be idle, got %d in flight and %d idle", p.inFlight, len(p.idle))
+	}
+}
+
+func TestPipelineResendsFailedBatchFirst(t *testing.T) {
+
+	p, fakes, flights := testInFlightPipeline(t, 2, "http:503")
+	source := &testSource{}
+	tracker := newMessageTracker(1, source)
+	defer tracker.close()
+
+	first := p.active
+	bufferTracked(t, p, tracker, "", "a", "b")
+	p.sendIfTime(tracker)
+	second := p.active
+	bufferTracked(t, p, tracker, "", "c", "d")
+	p.sendIfTime(tracker)
+
+	// the first batch fails and keeps its documents
+	landLane(t, p, fakes, flights, first, tracker)
+	if reflect.DeepEqual(p.failed, []*destination{first}) == false || reflect.DeepEqual(messageIds(first.queued), []string{"a", "b"}) == false {
+		t.Fatalf("expected the first lane to have failed with a and b")
+	}
+
+	// with one batch still in flight there is only room for one more, the failed one goes first
+	bufferTracked(t, p, tracker, "", "e", "f")
+	p.sendIfTime(tracker)
+	if len(p.failed) != 0 || p.inFlight != 2 || p.stalled == false {
+		t.Fatalf("expected the failed batch to be resent and the next to wait, got %d failed, %d in flight", len(p.failed), p.inFlight)
+	}
+	if reflect.DeepEqual(messageIds(p.active.queued), []string{"e", "f"}) == false {
+		t.Errorf("expected e and f to wait, got %v", messageIds(p.active.queued))
+	}
+
+	landLane(t, p, fakes, flights, first, tracker)
+	landLane(t, p, fakes, flights, second, tracker)
+	waitForAcknowledged(t, source, "a", "b", "c", "d")
+}
+
+func TestPipelineHoldsLaterCopy(t *testing.T) {
+
+	p, fakes, flights := testInFlightPipeline(t, 2)
+	source := &testSource{}
+	tracker := newMessageTracker(1, source)
+	defer tracker.close()
+
+	first := p.active
+	bufferTracked(t, p, tracker, "", "a", "b")
+	p.sendIfTime(tracker)
+
+	// a newer copy of a must wait for the batch with the older copy
+	bufferTracked(t, p, tracker, "2", "a", "c")
+	p.sendIfTime(tracker)
+	if p.inFlight != 1 || p.stalled == false || p.waitingOn() != "a" {
+		t.Fatalf("expected the batch with the newer copy of a to wait, got %d in flight", p.inFlight)
+	}
+
+	landLane(t, p, fakes, flights, first, tracker)
+	if len(p.sending) != 0 {
+		t.Errorf("expected nothing to be held, got %v", p.sending)
+	}
+
+	second := p.active
+	p.sendIfTime(tracker)
+	if p.inFlight != 1 || p.stalled == true {
+		t.Fatalf("expected the batch with the newer copy to be sent")
+	}
+	landLane(t, p, fakes, flights, second, tracker)
+	waitForAcknowledged(t, source, "a", "b", "a", "c")
+	if added := append(fakes[first].Added(), fakes[second].Added()...); reflect.DeepEqual(added, [][]string{{"a", "b"}, {"a", "c"}}) == false {
+		t.Errorf("expected both copies of a to be added in order, got %v", added)
+	}
+}
+
+func TestPipelineAbandonsPanickedBatch(t *testing.T) {
+
+	p, fakes, flights := testInFlightPipeline(t, 1, "panic")
+	source := &testSource{}
+	tracker := newMessageTracker(1, source)
+
+	first := p.active
+	bufferTracked(t, p, tracker, "", "a", "b")
+	p.sendIfTime(tracker)
+	landLane(t, p, fakes, flights, first, tracker)
+	tracker.close()
+
+	// nothing is acknowledged so the messages are redelivered and the lane can be used again
+	if len(source.acknowledged) != 0 {
+		t.Errorf("expected nothing to be acknowledged, got %v", source.acknowledged)
+	}
+	if len(first.queued) != 0 || len(p.failed) != 0 || len(p.idle) != 1 || p.inFlight != 0 {
+		t.Errorf("expected the lane to be idle and empty, got %d queued", len(first.queued))
+	}
+}
+
+//
+// end of file
+//
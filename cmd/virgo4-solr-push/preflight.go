@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+//
+// pre-flight payload validation. Payloads are concatenated into a single update request so one that is not
+// well formed (or carries its own declaration or wrapper) causes SOLR to reject the whole batch. We check
+// each one before it is buffered, normalize what we can and reject the rest individually
+//
+
+// the destination name reported when a payload is rejected before it is sent anywhere
+var preflightDestination = "preflight"
+
+// character references, some of which refer to characters that are not valid in XML 1.0
+var charReferenceRe = regexp.MustCompile(`&#(x[0-9a-fA-F]+|[0-9]+);`)
+
+// the elements that may wrap the documents for each operation and the document elements themselves
+var xmlWrappers = map[string]map[string]bool{
+	"add":    {"update": true, "add": true},
+	"delete": {"update": true, "delete": true},
+}
+var xmlDocuments = map[string]map[string]bool{
+	"add":    {"doc": true},
+	"delete": {"id": true, "query": true},
+}
+
+// check and normalize a payload for the specified operation, returns an error if the payload cannot be sent
+func normalizePayload(config *ServiceConfig, id string, mode string, payload []byte) ([]byte, error) {
+
+	payload, removed := removeInvalidChars(payload, config.SolrFormat != "json")
+	if removed != 0 {
+		log.Printf("WARNING: removed %d invalid characters from id %s", removed, id)
+	}
+
+	if config.SolrFormat == "json" {
+		return normalizeJsonPayload(mode, payload)
+	}
+	return normalizeXmlPayload(mode, payload)
+}
+
+// remove any characters (and character references if requested) that are not valid in XML 1.0, along with
+// any invalid UTF-8. Returns the payload and the number of characters removed
+func removeInvalidChars(payload []byte, references bool) ([]byte, int) {
+
+	removed := 0
+	clean := payload
+
+	// only copy if we need to
+	for ix := 0; ix < len(payload); {
+		r, size := utf8.DecodeRune(payload[ix:])
+		if (r == utf8.RuneError && size == 1) || isXmlChar(r) == false {
+			if removed == 0 {
+				clean = append(make([]byte, 0, len(payload)), payload[:ix]...)
+			}
+			removed++
+		} else if removed != 0 {
+			clean = append(clean, payload[ix:ix+size]...)
+		}
+		ix += size
+	}
+
+	if references == true && bytes.Contains(clean, []byte("&#")) == true {
+		clean = charReferenceRe.ReplaceAllFunc(clean, func(ref []byte) []byte {
+			value := string(ref[2 : len(ref)-1])
+			var r uint64
+			var err error
+			if value[0] == 'x' {
+				r, err = strconv.ParseUint(value[1:], 16, 32)
+			} else {
+				r, err = strconv.ParseUint(value, 10, 32)
+			}
+			if err != nil || r > utf8.MaxRune || isXmlChar(rune(r)) == false {
+				removed++
+				return []byte{}
+			}
+			return ref
+		})
+	}
+
+	return clean, removed
+}
+
+// is the character valid in XML 1.0
+func isXmlChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		(r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// check the payload is a single well formed document (or the ids and queries for a delete) and strip any
+// declaration, comments and wrapping elements
+func normalizeXmlPayload(mode string, payload []byte) ([]byte, error) {
+
+	wrappers := xmlWrappers[mode]
+	documents := xmlDocuments[mode]
+
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	decoder.Strict = true
+
+	start, end := int64(-1), int64(-1)
+	count := 0
+	depth := 0
+	documentDepth := -1
+
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+
+		case xml.StartElement:
+			depth++
+			switch {
+			// anything goes inside a document
+			case documentDepth != -1:
+			case documents[t.Name.Local] == true:
+				if start == -1 {
+					start = offset
+				}
+				documentDepth = depth
+				count++
+			case wrappers[t.Name.Local] == true:
+			default:
+				return nil, fmt.Errorf("unexpected element <%s>", t.Name.Local)
+			}
+
+		case xml.EndElement:
+			if depth == documentDepth {
+				documentDepth = -1
+				end = decoder.InputOffset()
+			}
+			depth--
+
+		case xml.CharData:
+			if documentDepth == -1 && len(bytes.TrimSpace(t)) != 0 {
+				return nil, fmt.Errorf("unexpected text outside the document")
+			}
+		}
+	}
+
+	if count == 0 {
+		return nil, fmt.Errorf("no document in payload")
+	}
+
+	// each message is a single document, otherwise we cannot tell which one SOLR complains about
+	if mode == "add" && count != 1 {
+		return nil, fmt.Errorf("payload contains %d documents", count)
+	}
+
+	return payload[start:end], nil
+}
+
+// check the payload is a well formed document (or the id for a delete) and strip any wrapping array
+func normalizeJsonPayload(mode string, payload []byte) ([]byte, error) {
+
+	payload = bytes.TrimSpace(payload)
+
+	// a bare id to delete
+	if mode == "delete" && (len(payload) == 0 || payload[0] != '{') {
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("no document in payload")
+		}
+		return payload, nil
+	}
+
+	if json.Valid(payload) == false {
+		return nil, fmt.Errorf("payload is not valid JSON")
+	}
+
+	// a single document in an array
+	if payload[0] == '[' {
+		var documents []json.RawMessage
+		if err := json.Unmarshal(payload, &documents); err != nil {
+			return nil, err
+		}
+		if len(documents) != 1 {
+			return nil, fmt.Errorf("payload contains %d documents", len(documents))
+		}
+		payload = bytes.TrimSpace(documents[0])
+	}
+
+	if payload[0] != '{' {
+		return nil, fmt.Errorf("payload is not a document object")
+	}
+
+	return payload, nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNormalizePayload(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		format   string
+		mode     string
+		payload  string
+		expected string // the normalized payload, empty if it is rejected
+	}{
+		// valid payloads pass through untouched
+		{name: "xml document", format: "xml", mode: "add",
+			payload:  `<doc><field name="id">a</field><field name="title">caf&#xE9; &amp; ü</field></doc>`,
+			expected: `<doc><field name="id">a</field><field name="title">caf&#xE9; &amp; ü</field></doc>`},
+		{name: "xml delete", format: "xml", mode: "delete", payload: `<id>a</id>`, expected: `<id>a</id>`},
+		{name: "json document", format: "json", mode: "add",
+			payload: `{"id":"a","title":"café"}`, expected: `{"id":"a","title":"café"}`},
+		{name: "json delete", format: "json", mode: "delete", payload: `"a"`, expected: `"a"`},
+
+		// wrappers and declarations are stripped
+		{name: "xml wrapped", format: "xml", mode: "add",
+			payload:  `<?xml version="1.0"?><add><doc><field name="id">a</field></doc></add>`,
+			expected: `<doc><field name="id">a</field></doc>`},
+		{name: "json array", format: "json", mode: "add", payload: ` [{"id":"a"}] `, expected: `{"id":"a"}`},
+
+		// invalid characters are removed
+		{name: "invalid utf-8", format: "xml", mode: "add",
+			payload:  "<doc><field name=\"id\">a\xff\xfeb</field></doc>",
+			expected: `<doc><field name="id">ab</field></doc>`},
+		{name: "xml control characters", format: "xml", mode: "add",
+			payload:  "<doc><field name=\"id\">a\x00\x01\x1Fb\tc</field></doc>",
+			expected: "<doc><field name=\"id\">ab\tc</field></doc>"},
+		{name: "xml illegal character references", format: "xml", mode: "add",
+			payload:  `<doc><field name="id">a&#0;&#x1F;&#x110000;b&#10;</field></doc>`,
+			expected: `<doc><field name="id">ab&#10;</field></doc>`},
+		{name: "json invalid utf-8", format: "json", mode: "add",
+			payload: "{\"id\":\"a\xc3b\"}", expected: `{"id":"ab"}`},
+
+		// malformed payloads are rejected
+		{name: "xml not well formed", format: "xml", mode: "add", payload: `<doc><field name="id">a</doc>`},
+		{name: "xml two documents", format: "xml", mode: "add", payload: `<add><doc/><doc/></add>`},
+		{name: "xml unexpected element", format: "xml", mode: "add", payload: `<commit/>`},
+		{name: "xml text outside the document", format: "xml", mode: "add", payload: `<add>oops<doc/></add>`},
+		{name: "xml no document", format: "xml", mode: "add", payload: `<add></add>`},
+		{name: "json not valid", format: "json", mode: "add", payload: `{"id":"a"`},
+		{name: "json two documents", format: "json", mode: "add", payload: `[{"id":"a"},{"id":"b"}]`},
+		{name: "json not an object", format: "json", mode: "add", payload: `"a"`},
+		{name: "json empty delete", format: "json", mode: "delete", payload: ` `},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := testConfig()
+			config.SolrFormat = test.format
+			got, err := normalizePayload(&config, "a", test.mode, []byte(test.payload))
+
+			if len(test.expected) == 0 {
+				if err == nil {
+					t.Errorf("expected the payload to be rejected, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if bytes.Equal(got, []byte(test.expected)) == false {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRemoveInvalidCharsDoesNotCopy(t *testing.T) {
+
+	// a valid payload is returned as it is
+	payload := []byte(`<doc><field name="id">a</field></doc>`)
+	clean, removed := removeInvalidChars(payload, true)
+	if removed != 0 || &clean[0] != &payload[0] {
+		t.Errorf("expected the payload itself, got a copy with %d removed", removed)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+)
+
+// an update request body made up of its segments in order. The document payloads are referenced rather than
+// copied, so the request is streamed to SOLR and can be rebuilt for a retry without building a large buffer
+type requestBody [][]byte
+
+// the size of the body in bytes
+func (b requestBody) size() int {
+
+	size := 0
+	for _, segment := range b {
+		size += len(segment)
+	}
+	return size
+}
+
+// a new reader for the body, each one reads it from the start
+func (b requestBody) reader() io.Reader {
+	return &segmentReader{segments: b}
+}
+
+// reads the segments of a request body one after the other
+type segmentReader struct {
+	segments [][]byte // the segments to read
+	current  int      // the segment we are reading
+	offset   int      // how far through the current segment we are
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+
+	n := 0
+	for n < len(p) && r.current < len(r.segments) {
+		copied := copy(p[n:], r.segments[r.current][r.offset:])
+		n += copied
+		r.offset += copied
+		if r.offset == len(r.segments[r.current]) {
+			r.current++
+			r.offset = 0
+		}
+	}
+
+	if n == 0 && r.current >= len(r.segments) {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// the content encoding we use for the body, compressing it if we are configured to and it is worth it
+func (s *solrImpl) bodyEncoding(body requestBody) string {
+
+	if s.gzip == false || body.size() < gzipMinSize {
+		return ""
+	}
+	return "gzip"
+}
+
+// a new stream of the body in the specified encoding, called for each attempt
+func (s *solrImpl) bodyStream(body requestBody, encoding string) io.ReadCloser {
+
+	if encoding != "gzip" {
+		return io.NopCloser(body.reader())
+	}
+
+	// compress the body as it is sent. If the request finishes early, closing the reader stops the compression
+	reader, writer := io.Pipe()
+	go func() {
+		compressed := &countingWriter{writer: writer}
+		zipper := gzip.NewWriter(compressed)
+		uncompressed, err := io.Copy(zipper, body.reader())
+		if err == nil {
+			err = zipper.Close()
+		}
+		if err == nil {
+			log.Printf("worker %d: compressed request from %d to %d bytes (%0.1f%%)", s.workerId, uncompressed, compressed.count,
+				100*float64(compressed.count)/float64(uncompressed))
+			uncompressedBytes.WithLabelValues(s.Config.DestinationName).Observe(float64(uncompressed))
+			compressedBytes.WithLabelValues(s.Config.DestinationName).Observe(float64(compressed.count))
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+// counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+//
+// end of file
+//
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how much the limit is reduced when SOLR is overloaded
+var limiterDecrease = 0.5
+
+// returned when we stop waiting for the limiter because we are shutting down
+var ErrShuttingDown = fmt.Errorf("shutting down")
+
+// limits the number of concurrent update and commit requests made to a single destination by all the workers.
+// The limit grows by one for each round of requests that SOLR handles quickly and is halved when SOLR is
+// slow, failing or timing out, so that merges and replica recovery slow us down rather than time us out
+type requestLimiter struct {
+	sync.Mutex
+	available    chan struct{} // closed (and replaced) when a request finishes
+	timeout      time.Duration // how long a request can take
+	name         string        // the destination name
+	limit        float64       // the current limit, the whole part is the number of requests allowed
+	minLimit     float64       // the smallest limit
+	maxLimit     float64       // the largest limit, zero if there is no limit
+	target       time.Duration // requests slower than this mean SOLR is struggling
+	inFlight     int           // the number of requests being made
+	lastDecrease time.Time     // when we last reduced the limit, requests started before then are not counted again
+}
+
+// the request limiters for each destination
+var requestLimiters = make(map[string]*requestLimiter)
+
+// create the request limiters for each destination
+func createRequestLimiters(config *ServiceConfig) {
+
+	for _, dc := range config.Destinations {
+		requestLimiters[dc.Name] = newRequestLimiter(dc.Name, config)
+	}
+}
+
+// get the request limiter for the named destination
+func requestLimiterFor(name string) *requestLimiter {
+
+	l, found := requestLimiters[name]
+	if found == false {
+		// not created up front (so not shared), just make one without a limit
+		l = newRequestLimiter(name, &ServiceConfig{})
+	}
+	return l
+}
+
+func newRequestLimiter(name string, config *ServiceConfig) *requestLimiter {
+
+	l := &requestLimiter{
+		name:     name,
+		minLimit: float64(max(config.SolrMinConcurrency, 1)),
+		maxLimit: float64(config.SolrMaxConcurrency),
+		target:   time.Duration(config.SolrLatencyTarget) * time.Millisecond,
+		timeout:  time.Duration(config.SolrTimeout) * time.Second,
+	}
+	l.available = make(chan struct{})
+	l.minLimit = min(l.minLimit, l.maxLimit)
+	l.limit = l.maxLimit
+
+	concurrencyLimit.WithLabelValues(name).Set(float64(int(l.limit)))
+	return l
+}
+
+// wait until we can make a request or we are shutting down, returns when we started. The worker is live
+// while it waits as long as the requests ahead of it keep finishing
+func (l *requestLimiter) acquire(workerId int, stop <-chan struct{}) (time.Time, error) {
+
+	for {
+		l.Lock()
+		if l.maxLimit == 0 || l.inFlight < int(l.limit) {
+			l.inFlight++
+			requestsInFlight.WithLabelValues(l.name).Set(float64(l.inFlight))
+			l.Unlock()
+			return time.Now(), nil
+		}
+		available := l.available
+		l.Unlock()
+
+		// a request ahead of us should finish within its timeout
+		serviceHealth.waiting(workerId, "limited", l.timeout)
+
+		select {
+		case <-stop:
+			log.Printf("worker %d: WARNING shutting down, abandoning the wait for the %s request limit", workerId, l.name)
+			return time.Time{}, ErrShuttingDown
+		case <-available:
+		}
+	}
+}
+
+// a request has finished, adjust the limit from how it went
+func (l *requestLimiter) release(started time.Time, err error) {
+
+	latency := time.Since(started)
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.inFlight--
+	requestsInFlight.WithLabelValues(l.name).Set(float64(l.inFlight))
+	close(l.available)
+	l.available = make(chan struct{})
+
+	if l.maxLimit == 0 {
+		return
+	}
+
+	overloaded := isOverloaded(err) == true || (l.target != 0 && latency > l.target)
+	switch {
+	// the requests made at the same time all tell us the same thing, only count one of them
+	case overloaded == true && started.After(l.lastDecrease) == true:
+		previous := l.limit
+		l.limit = max(l.minLimit, l.limit*limiterDecrease)
+		l.lastDecrease = time.Now()
+		if int(l.limit) != int(previous) {
+			log.Printf("WARNING: %s request limit reduced from %d to %d (latency %s)", l.name, int(previous), int(l.limit), latency.Round(time.Millisecond))
+		}
+
+	case overloaded == false && err == nil:
+		l.limit = min(l.maxLimit, l.limit+1/l.limit)
+	}
+
+	concurrencyLimit.WithLabelValues(l.name).Set(float64(int(l.limit)))
+}
+
+// does the error mean SOLR is overloaded
+func isOverloaded(err error) bool {
+
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) == true {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return err != nil && isTimeout(err) == true
+}
+
+//
+// end of file
+//
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a request limiter for a destination of its own, starting at the specified limit
+func testRequestLimiter(t *testing.T, limit int, minLimit int, maxLimit int, target int) *requestLimiter {
+
+	name := fmt.Sprintf("limiter-%s", t.Name())
+	l := newRequestLimiter(name, &ServiceConfig{SolrMinConcurrency: minLimit, SolrMaxConcurrency: maxLimit, SolrLatencyTarget: target, SolrTimeout: 5})
+	l.limit = float64(limit)
+	return l
+}
+
+// the state reported for the worker
+func workerState(workerId int) string {
+	serviceHealth.Lock()
+	defer serviceHealth.Unlock()
+	return serviceHealth.worker(workerId).State
+}
+
+func TestRequestLimiterAdjusts(t *testing.T) {
+
+	overloaded := &HttpStatusError{StatusCode: http.StatusServiceUnavailable}
+	rejected := &HttpStatusError{StatusCode: http.StatusBadRequest}
+
+	// each request is made the specified time ago, requests made before the last decrease are part of the same round
+	type request struct {
+		ago time.Duration
+		err error
+	}
+
+	tests := []struct {
+		name     string
+		limit    int
+		min      int
+		max      int
+		target   int // milliseconds
+		requests []request
+		expected float64
+	}{
+		{name: "increase", limit: 2, min: 1, max: 4, requests: []request{{0, nil}}, expected: 2.5},
+		{name: "increase twice", limit: 2, min: 1, max: 4, requests: []request{{0, nil}, {0, nil}}, expected: 2.9},
+		{name: "increase to the maximum", limit: 4, min: 1, max: 4, requests: []request{{0, nil}}, expected: 4},
+		{name: "decrease", limit: 8, min: 1, max: 8, requests: []request{{0, overloaded}}, expected: 4},
+		{name: "decrease once a round", limit: 8, min: 1, max: 8, requests: []request{{0, overloaded}, {time.Second, overloaded}}, expected: 4},
+		{name: "decrease each round", limit: 8, min: 1, max: 8, requests: []request{{0, overloaded}, {0, overloaded}}, expected: 2},
+		{name: "decrease when slow", limit: 8, min: 1, max: 8, target: 100, requests: []request{{time.Second, nil}}, expected: 4},
+		{name: "decrease to the floor", limit: 3, min: 2, max: 8, requests: []request{{0, overloaded}}, expected: 2},
+		{name: "stay on the floor", limit: 2, min: 2, max: 8, requests: []request{{0, overloaded}, {0, overloaded}}, expected: 2},
+		{name: "rejection ignored", limit: 2, min: 1, max: 4, requests: []request{{0, rejected}}, expected: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := testRequestLimiter(t, test.limit, test.min, test.max, test.target)
+			for _, r := range test.requests {
+				l.inFlight++
+				l.release(time.Now().Add(-r.ago), r.err)
+			}
+
+			if fmt.Sprintf("%.1f", l.limit) != fmt.Sprintf("%.1f", test.expected) {
+				t.Errorf("expected a limit of %.1f, got %.1f", test.expected, l.limit)
+			}
+			if l.inFlight != 0 {
+				t.Errorf("expected no requests in flight, got %d", l.inFlight)
+			}
+		})
+	}
+}
+
+func TestRequestLimiterConcurrentAcquire(t *testing.T) {
+
+	l := testRequestLimiter(t, 2, 1, 2, 0)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	started := make([]time.Time, 0, 2)
+	for ix := 0; ix < 2; ix++ {
+		s, err := l.acquire(901, stop)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		started = append(started, s)
+	}
+
+	// the third waits until one of the others finishes
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(902, stop)
+		acquired <- err
+	}()
+
+	waitFor(t, "the wait to be reported", func() bool { return workerState(902) == "limited" })
+	select {
+	case <-acquired:
+		t.Fatalf("expected acquire to wait at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.release(started[0], nil)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected acquire to return once a request finished")
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.inFlight != 2 {
+		t.Errorf("expected 2 requests in flight, got %d", l.inFlight)
+	}
+}
+
+func TestRequestLimiterStop(t *testing.T) {
+
+	l := testRequestLimiter(t, 1, 1, 1, 0)
+	stop := make(chan struct{})
+	if _, err := l.acquire(903, stop); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// shutting down stops the wait without taking a request
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(904, stop)
+		acquired <- err
+	}()
+
+	waitFor(t, "the wait to be reported", func() bool { return workerState(904) == "limited" })
+	close(stop)
+	select {
+	case err := <-acquired:
+		if err != ErrShuttingDown {
+			t.Errorf("expected %v, got %v", ErrShuttingDown, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected acquire to return when stopped")
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.inFlight != 1 {
+		t.Errorf("expected 1 request in flight, got %d", l.inFlight)
+	}
+}
+
+func TestRequestLimiterUnlimited(t *testing.T) {
+
+	l := testRequestLimiter(t, 0, 0, 0, 0)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for ix := 0; ix < 10; ix++ {
+		if _, err := l.acquire(905, stop); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+}
+
+//
+// end of file
+//
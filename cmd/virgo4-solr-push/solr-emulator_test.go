@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/antchfx/xmlquery"
+)
+
+//
+// a local SOLR stand-in. It serves the update, ping and uniqueKey schema endpoints for a single core, keeps an in-memory index
+// keyed by the uniqueKey field and returns real SOLR response payloads, including the error payloads that
+// processResponsePayload must understand. Failures are injected on demand, either programmatically or using
+// the same script syntax as the fake SOLR implementation (see solr-fake.go).
+//
+
+// EmulatorFailure is a single injected update failure
+type EmulatorFailure struct {
+	Status  int      // the HTTP status (and responseHeader status) to return
+	Message string   // the error message returned in the payload
+	Ids     []string // the documents that fail, reported individually when the request uses an update chain
+	Commit  bool     // only a commit fails, other updates proceed normally
+}
+
+// SolrEmulator is our SOLR stand-in
+type SolrEmulator struct {
+	sync.Mutex                    // protects the state below
+	server      *httptest.Server  // the underlying HTTP server
+	core        string            // the core name
+	uniqueKey   string            // the uniqueKey field name
+	index       map[string][]byte // the documents indexed, by uniqueKey
+	failures    []EmulatorFailure // the pending injected update failures
+	commits     int               // the number of commits received
+	updates     int               // the number of update requests received
+	pingFails   []int             // the pending injected ping failures
+	commitFails []int             // the pending injected commit failures
+	lastBodies  [][]byte          // the most recent update bodies received
+	noGzip      bool              // reject compressed update requests
+}
+
+// how many update bodies we keep
+var emulatorBodyHistory = 10
+
+// NewSolrEmulator creates and starts a SOLR emulator for the specified core
+func NewSolrEmulator(core string, uniqueKey string) *SolrEmulator {
+
+	emu := &SolrEmulator{core: core, uniqueKey: uniqueKey, index: make(map[string][]byte)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/%s/update", core), emu.handleUpdate)
+	mux.HandleFunc(fmt.Sprintf("/%s/admin/ping", core), emu.handlePing)
+	mux.HandleFunc(fmt.Sprintf("/%s/schema/uniquekey", core), emu.handleUniqueKey)
+	emu.server = httptest.NewServer(mux)
+
+	return emu
+}
+
+// URL returns the base URL of the emulator (equivalent to the SOLR URL configuration)
+func (e *SolrEmulator) URL() string {
+	return e.server.URL
+}
+
+// Close stops the emulator
+func (e *SolrEmulator) Close() {
+	e.server.Close()
+}
+
+// Script injects failures using the fake SOLR script syntax
+func (e *SolrEmulator) Script(script string) error {
+
+	outcomes, err := parseFakeScript(script)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range outcomes {
+		switch o.Kind {
+		case "ok":
+			e.Fail(EmulatorFailure{})
+		case "faildoc", "rejectdoc":
+			e.FailDocNumber(o.Arg)
+		case "rejectid":
+			e.RejectDoc(o.Arg)
+		case "errors":
+			e.FailIds(strings.Split(o.Arg, ";")...)
+		case "conflict":
+			e.FailConflict()
+		case "reject":
+			e.Fail(EmulatorFailure{Status: http.StatusBadRequest, Message: "Document contains multiple values for uniqueKey field"})
+		case "http":
+			status, _ := strconv.Atoi(o.Arg)
+			e.FailStatus(status)
+		case "commit":
+			status, _ := strconv.Atoi(o.Arg)
+			e.FailCommit(status)
+		default:
+			return fmt.Errorf("the emulator does not support [%s]", o.Kind)
+		}
+	}
+	return nil
+}
+
+// Fail queues an update failure, commits are updates too so this fails the next update of any kind. A zero status means the update proceeds normally
+func (e *SolrEmulator) Fail(failure EmulatorFailure) {
+	e.Lock()
+	defer e.Unlock()
+	e.failures = append(e.failures, failure)
+}
+
+// RejectDoc queues an update failure that identifies the failing document by id
+func (e *SolrEmulator) RejectDoc(id string) {
+	e.Fail(EmulatorFailure{Status: http.StatusBadRequest, Message: emulatorDocumentError(id)})
+}
+
+// FailIds queues an update failure of the specified documents. If the request uses an update chain (as the
+// TolerantUpdateProcessor requires) the other documents are applied and the failures are listed in the
+// response header, otherwise the whole update fails identifying the first of them
+func (e *SolrEmulator) FailIds(ids ...string) {
+	e.Fail(EmulatorFailure{Status: http.StatusBadRequest, Ids: ids, Message: emulatorDocumentError(ids[0])})
+}
+
+// the error SOLR reports for a document it cannot add
+func emulatorDocumentError(id string) string {
+	return fmt.Sprintf("ERROR: [doc=%s] Error adding field 'published_date'='1969' msg=Invalid Date String:'1969'", id)
+}
+
+// FailConflict queues an update failure because the request contains a stale version of a document, doc-based
+// versioning does not say which one
+func (e *SolrEmulator) FailConflict() {
+	e.Fail(EmulatorFailure{Status: http.StatusConflict, Message: "user version is not high enough: 1"})
+}
+
+// FailDocNumber queues an update failure that identifies the failing document by number
+func (e *SolrEmulator) FailDocNumber(docNum string) {
+	e.Fail(EmulatorFailure{Status: http.StatusBadRequest,
+		Message: fmt.Sprintf("Unexpected close tag </doc>; expected </field>.\n at [row,col {unknown-source}]: [%s,1]", docNum)})
+}
+
+// FailStatus queues an update failure with the specified status
+func (e *SolrEmulator) FailStatus(status int) {
+	e.Fail(EmulatorFailure{Status: status, Message: http.StatusText(status)})
+}
+
+// FailCommit queues a failure of the next commit with the specified status
+func (e *SolrEmulator) FailCommit(status int) {
+	e.Lock()
+	defer e.Unlock()
+	e.commitFails = append(e.commitFails, status)
+}
+
+// RejectGzip makes the emulator reject compressed update requests
+func (e *SolrEmulator) RejectGzip() {
+	e.Lock()
+	defer e.Unlock()
+	e.noGzip = true
+}
+
+// FailPing queues a ping failure with the specified status
+func (e *SolrEmulator) FailPing(status int) {
+	e.Lock()
+	defer e.Unlock()
+	e.pingFails = append(e.pingFails, status)
+}
+
+// Doc returns the indexed document with the specified id
+func (e *SolrEmulator) Doc(id string) ([]byte, bool) {
+	e.Lock()
+	defer e.Unlock()
+	doc, found := e.index[id]
+	return doc, found
+}
+
+// DocCount returns the number of documents in the index
+func (e *SolrEmulator) DocCount() int {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.index)
+}
+
+// Commits returns the number of commits received
+func (e *SolrEmulator) Commits() int {
+	e.Lock()
+	defer e.Unlock()
+	return e.commits
+}
+
+// Updates returns the number of update requests received
+func (e *SolrEmulator) Updates() int {
+	e.Lock()
+	defer e.Unlock()
+	return e.updates
+}
+
+// LastBodies returns the most recent update request bodies
+func (e *SolrEmulator) LastBodies() [][]byte {
+	e.Lock()
+	defer e.Unlock()
+	return append([][]byte{}, e.lastBodies...)
+}
+
+func (e *SolrEmulator) handlePing(w http.ResponseWriter, r *http.Request) {
+
+	e.Lock()
+	status := http.StatusOK
+	if len(e.pingFails) != 0 {
+		status = e.pingFails[0]
+		e.pingFails = e.pingFails[1:]
+	}
+	e.Unlock()
+
+	if status != http.StatusOK {
+		e.writeError(w, r, status, http.StatusText(status))
+		return
+	}
+
+	e.writeResponse(w, r, `<str name="status">OK</str>`)
+}
+
+func (e *SolrEmulator) handleUniqueKey(w http.ResponseWriter, r *http.Request) {
+
+	if e.wantsJson(r) == true {
+		quoted, _ := json.Marshal(e.uniqueKey)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"responseHeader":{"status":0,"QTime":1},"uniqueKey":%s}`, quoted)
+		return
+	}
+
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(e.uniqueKey))
+	e.writeResponse(w, r, fmt.Sprintf(`<str name="uniqueKey">%s</str>`, escaped.String()))
+}
+
+func (e *SolrEmulator) handleUpdate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		e.writeError(w, r, http.StatusMethodNotAllowed, "update requires POST")
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if e.noGzip == true {
+			e.writeError(w, r, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding: gzip")
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			e.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		reader = gz
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		e.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	e.updates++
+	e.lastBodies = append(e.lastBodies, body)
+	if len(e.lastBodies) > emulatorBodyHistory {
+		e.lastBodies = e.lastBodies[1:]
+	}
+
+	// any injected failure
+	var failedIds []string
+	if len(e.failures) != 0 {
+		failure := e.failures[0]
+		e.failures = e.failures[1:]
+		if len(failure.Ids) != 0 && len(r.URL.Query().Get("update.chain")) != 0 {
+			failedIds = failure.Ids
+		} else if failure.Status != 0 {
+			e.writeError(w, r, failure.Status, failure.Message)
+			return
+		}
+	}
+
+	skip := make(map[string]bool, len(failedIds))
+	for _, id := range failedIds {
+		skip[id] = true
+	}
+
+	var status int
+	var msg string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") == true {
+		status, msg = e.applyJsonUpdate(body, skip)
+	} else {
+		status, msg = e.applyUpdate(body, skip)
+	}
+	if status != http.StatusOK {
+		e.writeError(w, r, status, msg)
+		return
+	}
+
+	if len(failedIds) != 0 {
+		e.writeErrorsResponse(w, r, failedIds)
+		return
+	}
+
+	e.writeResponse(w, r, "")
+}
+
+// apply the XML update commands in the body to the index, returns the status and any error message. Multiple
+// commands may be wrapped in an update element and are applied in order. Any documents in skip are not added
+func (e *SolrEmulator) applyUpdate(body []byte, skip map[string]bool) (int, string) {
+
+	doc, err := xmlquery.Parse(bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Unexpected character in update body: %s", err.Error())
+	}
+
+	operations := make([]emulatorOperation, 0)
+	commit := false
+
+	// validate everything first, SOLR does not add any documents in a batch that fails this way
+	for _, command := range xmlquery.Find(doc, "/update/* | /*[name() != 'update']") {
+		switch command.Data {
+		case "add":
+			for _, d := range xmlquery.Find(command, "doc") {
+				keyNode := xmlquery.FindOne(d, fmt.Sprintf("field[@name='%s']", e.uniqueKey))
+				if keyNode == nil {
+					return http.StatusBadRequest, fmt.Sprintf("Document is missing mandatory uniqueKey field: %s", e.uniqueKey)
+				}
+				operations = append(operations, emulatorOperation{id: keyNode.InnerText(), doc: []byte(d.OutputXML(true))})
+			}
+		case "delete":
+			for _, id := range xmlquery.Find(command, "id") {
+				operations = append(operations, emulatorOperation{id: id.InnerText()})
+			}
+			for _, q := range xmlquery.Find(command, "query") {
+				if strings.TrimSpace(q.InnerText()) == "*:*" {
+					operations = append(operations, emulatorOperation{id: "*:*"})
+				}
+			}
+		case "commit":
+			commit = true
+		}
+	}
+
+	if commit == true {
+		if status, failed := e.nextCommitFailure(); failed == true {
+			return status, http.StatusText(status)
+		}
+	}
+
+	e.applyOperations(operations, skip)
+	if commit == true {
+		e.commits++
+	}
+
+	return http.StatusOK, ""
+}
+
+// apply the JSON update commands in the body to the index, returns the status and any error message. We support
+// both the document array form and the command object form. Any documents in skip are not added
+func (e *SolrEmulator) applyJsonUpdate(body []byte, skip map[string]bool) (int, string) {
+
+	operations := make([]emulatorOperation, 0)
+	commit := false
+
+	// validate everything first, SOLR does not add any documents in a batch that fails this way
+	addDoc := func(raw json.RawMessage) (int, string) {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Expected a document object: %s", err.Error())
+		}
+		id, found := fields[e.uniqueKey]
+		if found == false {
+			return http.StatusBadRequest, fmt.Sprintf("Document is missing mandatory uniqueKey field: %s", e.uniqueKey)
+		}
+		operations = append(operations, emulatorOperation{id: fmt.Sprint(id), doc: raw})
+		return http.StatusOK, ""
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	token, err := dec.Token()
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Cannot parse provided JSON: %s", err.Error())
+	}
+
+	switch token {
+
+	// an array of documents
+	case json.Delim('['):
+		for dec.More() {
+			var raw json.RawMessage
+			if err = dec.Decode(&raw); err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Cannot parse provided JSON: %s", err.Error())
+			}
+			if status, msg := addDoc(raw); status != http.StatusOK {
+				return status, msg
+			}
+		}
+
+	// command objects, the keys may be repeated so we must read them in order
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Cannot parse provided JSON: %s", err.Error())
+			}
+			var raw json.RawMessage
+			if err = dec.Decode(&raw); err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Cannot parse provided JSON: %s", err.Error())
+			}
+
+			switch key {
+			case "add":
+				var cmd struct {
+					Doc json.RawMessage `json:"doc"`
+				}
+				if err = json.Unmarshal(raw, &cmd); err != nil || len(cmd.Doc) == 0 {
+					return http.StatusBadRequest, "Expected a doc in the add command"
+				}
+				if status, msg := addDoc(cmd.Doc); status != http.StatusOK {
+					return status, msg
+				}
+
+			case "delete":
+				var ids []string
+				var cmd struct {
+					Id    interface{} `json:"id"`
+					Query string      `json:"query"`
+				}
+				var id interface{}
+				if err = json.Unmarshal(raw, &cmd); err == nil {
+					if cmd.Query == "*:*" {
+						operations = append(operations, emulatorOperation{id: "*:*"})
+					}
+					if cmd.Id != nil {
+						ids = append(ids, fmt.Sprint(cmd.Id))
+					}
+				} else if err = json.Unmarshal(raw, &ids); err != nil {
+					if err = json.Unmarshal(raw, &id); err != nil {
+						return http.StatusBadRequest, "Unexpected delete command"
+					}
+					ids = append(ids, fmt.Sprint(id))
+				}
+				for _, id := range ids {
+					operations = append(operations, emulatorOperation{id: id})
+				}
+
+			case "commit":
+				commit = true
+			}
+		}
+
+	default:
+		return http.StatusBadRequest, "Cannot parse provided JSON: expected an object or array"
+	}
+
+	if commit == true {
+		if status, failed := e.nextCommitFailure(); failed == true {
+			return status, http.StatusText(status)
+		}
+	}
+
+	e.applyOperations(operations, skip)
+	if commit == true {
+		e.commits++
+	}
+
+	return http.StatusOK, ""
+}
+
+// the next injected commit failure if there is one, nothing in a request that fails this way is applied
+func (e *SolrEmulator) nextCommitFailure() (int, bool) {
+
+	if len(e.commitFails) == 0 {
+		return 0, false
+	}
+	status := e.commitFails[0]
+	e.commitFails = e.commitFails[1:]
+	return status, true
+}
+
+// a single add or delete operation
+type emulatorOperation struct {
+	id  string // the document id, *:* deletes everything
+	doc []byte // the document, nil for deletes
+}
+
+// apply the operations to the index in order, skipping any adds of the specified documents
+func (e *SolrEmulator) applyOperations(operations []emulatorOperation, skip map[string]bool) {
+
+	for _, op := range operations {
+		if op.doc != nil && skip[op.id] == true {
+			continue
+		}
+		if op.doc != nil {
+			e.index[op.id] = op.doc
+		} else if op.id == "*:*" {
+			e.index = make(map[string][]byte)
+		} else {
+			delete(e.index, op.id)
+		}
+	}
+}
+
+// does the request want a JSON response
+func (e *SolrEmulator) wantsJson(r *http.Request) bool {
+	return r.URL.Query().Get("wt") == "json"
+}
+
+func (e *SolrEmulator) writeResponse(w http.ResponseWriter, r *http.Request, content string) {
+
+	if e.wantsJson(r) == true {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"responseHeader":{"status":0,"QTime":1}}`)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<response>
+<lst name="responseHeader">
+  <int name="status">0</int>
+  <int name="QTime">1</int>
+</lst>
+%s
+</response>
+`, content)
+}
+
+// write a successful response listing the documents that failed, as the TolerantUpdateProcessor does
+func (e *SolrEmulator) writeErrorsResponse(w http.ResponseWriter, r *http.Request, ids []string) {
+
+	if e.wantsJson(r) == true {
+		errors := make([]map[string]string, 0, len(ids))
+		for _, id := range ids {
+			errors = append(errors, map[string]string{"type": "ADD", "id": id, "message": emulatorDocumentError(id)})
+		}
+		encoded, _ := json.Marshal(errors)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"responseHeader":{"errors":%s,"maxErrors":-1,"status":0,"QTime":1}}`, encoded)
+		return
+	}
+
+	var list bytes.Buffer
+	for _, id := range ids {
+		var escapedId, escapedMsg bytes.Buffer
+		_ = xml.EscapeText(&escapedId, []byte(id))
+		_ = xml.EscapeText(&escapedMsg, []byte(emulatorDocumentError(id)))
+		fmt.Fprintf(&list, `
+    <lst>
+      <str name="type">ADD</str>
+      <str name="id">%s</str>
+      <str name="message">%s</str>
+    </lst>`, escapedId.String(), escapedMsg.String())
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<response>
+<lst name="responseHeader">
+  <arr name="errors">%s
+  </arr>
+  <int name="maxErrors">-1</int>
+  <int name="status">0</int>
+  <int name="QTime">1</int>
+</lst>
+</response>
+`, list.String())
+}
+
+func (e *SolrEmulator) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+
+	if e.wantsJson(r) == true {
+		quoted, _ := json.Marshal(msg)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"responseHeader":{"status":%d,"QTime":1},"error":{"metadata":["error-class","org.apache.solr.common.SolrException","root-error-class","org.apache.solr.common.SolrException"],"msg":%s,"code":%d}}`,
+			status, quoted, status)
+		return
+	}
+
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(msg))
+
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<response>
+<lst name="responseHeader">
+  <int name="status">%d</int>
+  <int name="QTime">1</int>
+</lst>
+<lst name="error">
+  <lst name="metadata">
+    <str name="error-class">org.apache.solr.common.SolrException</str>
+    <str name="root-error-class">org.apache.solr.common.SolrException</str>
+  </lst>
+  <str name="msg">%s</str>
+  <int name="code">%d</int>
+</lst>
+</response>
+`, status, escaped.String(), status)
+}
+
+//
+// end of file
+//
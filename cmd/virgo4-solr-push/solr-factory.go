@@ -4,6 +4,7 @@ import (
 	//"fmt"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -14,14 +15,27 @@ type solrImpl struct {
 	PostUrl    string        // the actual URL to Add/Commit too
 	PingUrl    string        // the actual URL to Ping
 
+	format  solrFormat      // the wire format we use
+	breaker *circuitBreaker // shared with the other workers using this destination
+	sizer   *batchSizer     // when it is time to add, shared with the other workers using this destination
+	limiter *requestLimiter // limits concurrent update and commit requests, shared with the other workers using this destination
+	retry   retryPolicy     // how we retry failed requests
+	gzip    bool            // compress update requests, cleared if SOLR does not accept them
+	stop    <-chan struct{} // closed when we are shutting down, we stop waiting to retry
+	budget  *memoryBudget   // the memory budget our buffer counts against, nil if it does not count
+
 	// internal state stuff
-	lastCommit     time.Time // when we did our last commit to SOLR
-	lastAdd        time.Time // when we did our last add to SOLR
-	solrDirty      bool      // we have added documents to SOLR without committing
-	pendingAdds    uint      // how many documents in the add buffer
-	pendingAddIds  []string  // our document add buffer
-	addBuffer      []byte    // our document add buffer
-	sendBufferSize uint      // the default document add buffer size
+	lastCommit     time.Time     // when we did our last commit to SOLR
+	lastAdd        time.Time     // when we did our last add to SOLR
+	solrDirty      bool          // we have added documents to SOLR without committing
+	pendingAdds    uint          // how many documents in the add buffer
+	pendingAddIds  []string      // our document add buffer
+	pendingMode    string        // the operation of the current command block (add or delete)
+	pendingBody    requestBody   // the buffered update request, the documents are not copied
+	pendingBytes   int           // the size of the buffered update request
+	sendBufferSize uint          // the default document add buffer size
+	lastError      string        // the most recent error message reported by SOLR
+	roundTrip      time.Duration // how long the last update or commit attempt took, excluding any waiting
 
 	workerId int // used for logging
 
@@ -29,19 +43,45 @@ type solrImpl struct {
 }
 
 // Initialize our SOLR implementation
-func newSolr(id int, config ServiceConfig) (SOLR, error) {
+func newSolr(id int, config ServiceConfig, stop <-chan struct{}) (SOLR, error) {
+
+	format, err := newSolrFormat(config.SolrFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	impl := &solrImpl{Config: config, workerId: id, format: format, stop: stop}
+	impl.breaker = circuitBreakerFor(config.DestinationName)
+	impl.sizer = batchSizerFor(config)
+	impl.limiter = requestLimiterFor(config.DestinationName)
+	impl.retry = newRetryPolicy(config)
+	impl.gzip = config.SolrGzip
+
+	// only the required destinations count against the memory budget, an optional one that is paused must
+	// not stop us taking messages
+	if config.DestinationRequired == true {
+		impl.budget = bufferBudget
+	}
+
+	// if we are using a tolerant update chain, SOLR reports the failing documents and adds the others
+	params := format.UrlParams()
+	if len(config.SolrUpdateChain) != 0 {
+		params.Set("update.chain", config.SolrUpdateChain)
+		params.Set("maxErrors", strconv.Itoa(config.SolrMaxErrors))
+	}
 
-	impl := &solrImpl{Config: config, workerId: id}
 	impl.PostUrl = fmt.Sprintf("%s/%s/update", config.SolrUrl, config.SolrCoreName)
+	if len(params) != 0 {
+		impl.PostUrl += "?" + params.Encode()
+	}
 	impl.PingUrl = fmt.Sprintf("%s/%s/admin/ping", config.SolrUrl, config.SolrCoreName)
 
 	// cos zero values are not correct
 	impl.lastCommit = time.Now()
 	impl.lastAdd = time.Now()
 
-	// turn into megabytes and allocate the send buffer
+	// turn into megabytes, the request is streamed so nothing is allocated up front
 	impl.sendBufferSize = 1024 * 1024 * config.SolrBufferSize
-	impl.addBuffer = make([]byte, 0, impl.sendBufferSize)
 
 	// configure the client
 	impl.httpClient = &http.Client{
@@ -51,7 +91,22 @@ func newSolr(id int, config ServiceConfig) (SOLR, error) {
 		Timeout: time.Duration(config.SolrTimeout) * time.Second,
 	}
 
-	return impl, impl.IsAlive()
+	// if SOLR is not available, the circuit breaker probes it
+	err = impl.IsAlive()
+	impl.breaker.setProbe(newSolrProbe(id, config, impl.PingUrl))
+
+	return impl, err
+}
+
+// the circuit breaker probes SOLR from its own goroutine while we are in use, so it gets its own connection
+// and shares none of our state
+func newSolrProbe(id int, config ServiceConfig, pingUrl string) func() error {
+
+	probe := &solrImpl{Config: config, workerId: id, PingUrl: pingUrl}
+	probe.breaker = circuitBreakerFor(config.DestinationName)
+	probe.retry = newRetryPolicy(config)
+	probe.httpClient = &http.Client{Timeout: time.Duration(config.SolrTimeout) * time.Second}
+	return probe.IsAlive
 }
 
 //
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// a fake, in-memory SOLR implementation. It records the documents buffered, the document adds and the commits
+// and replays a script of outcomes so the worker recovery logic can be exercised without a SOLR instance.
+//
+// The script is a comma separated list of outcomes, each one is consumed by a single ForceAdd. Once the
+// script is exhausted every add succeeds. Supported outcomes are:
+//
+//   ok           - all documents are added
+//   faildoc:N    - document number N fails (the documents before it are added)
+//   rejectid:X   - all documents are rejected because of document id X
+//   rejectdoc:N  - all documents are rejected because of document number N
+//   reject       - all documents are rejected and no document is identified
+//   errors:X;Y   - a tolerant update chain reports document ids X and Y failed (the others are added)
+//   conflict:X   - nothing is added because a newer version of document id X is already indexed
+//   http:NNN     - the request fails with the specified HTTP status
+//   commit:NNN   - the next commit fails with the specified HTTP status
+//   panic        - the add panics
+//
+
+// FakeOutcome is a single scripted ForceAdd outcome
+type FakeOutcome struct {
+	Kind string // ok, faildoc, rejectid, rejectdoc, reject, errors, conflict, http, commit or panic
+	Arg  string // the outcome argument
+}
+
+// FakeBuffered is a single document given to BufferDoc
+type FakeBuffered struct {
+	Id      string
+	Mode    string
+	Payload []byte
+}
+
+// this is our fake implementation
+type solrFake struct {
+	Config ServiceConfig // our original configuration object
+
+	sync.Mutex                 // protects the recorded state
+	script      []FakeOutcome  // the remaining scripted outcomes
+	buffered    []FakeBuffered // every document buffered
+	pending     []FakeBuffered // the documents buffered since the last add
+	added       [][]string     // the ids of the documents added, one entry per add
+	commits     int            // the number of successful commits
+	commitFails []int          // the scripted commit failures
+	lastError   string         // the most recent error message
+	gate        chan struct{}  // if set, each add waits to receive from it
+
+	lastCommit time.Time // when we did our last commit
+	lastAdd    time.Time // when we did our last add
+	solrDirty  bool      // we have added documents without committing
+
+	workerId int // used for logging
+}
+
+// Initialize our fake SOLR implementation with the specified script
+func newSolrFake(id int, config ServiceConfig, script string) (*solrFake, error) {
+
+	impl := &solrFake{Config: config, workerId: id}
+	impl.lastCommit = time.Now()
+	impl.lastAdd = time.Now()
+
+	outcomes, err := parseFakeScript(script)
+	if err != nil {
+		return nil, err
+	}
+	impl.Script(outcomes...)
+
+	return impl, nil
+}
+
+// parse the scripted outcomes from their string form
+func parseFakeScript(script string) ([]FakeOutcome, error) {
+
+	outcomes := make([]FakeOutcome, 0)
+	if len(script) == 0 {
+		return outcomes, nil
+	}
+
+	for _, s := range strings.Split(script, ",") {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(s), ":")
+		switch kind {
+		case "ok", "reject", "panic":
+		// document numbers start at 1
+		case "faildoc", "rejectdoc":
+			if n, err := strconv.Atoi(arg); err != nil || n < 1 {
+				return nil, fmt.Errorf("bad fake script outcome [%s]", s)
+			}
+		case "http", "commit":
+			if n, err := strconv.Atoi(arg); err != nil || n < 100 || n > 599 {
+				return nil, fmt.Errorf("bad fake script outcome [%s]", s)
+			}
+		case "rejectid", "errors", "conflict":
+			if len(arg) == 0 {
+				return nil, fmt.Errorf("bad fake script outcome [%s]", s)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fake script outcome [%s]", s)
+		}
+		outcomes = append(outcomes, FakeOutcome{Kind: kind, Arg: arg})
+	}
+
+	return outcomes, nil
+}
+
+// Script appends outcomes to the script
+func (s *solrFake) Script(outcomes ...FakeOutcome) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, o := range outcomes {
+		if o.Kind == "commit" {
+			status, _ := strconv.Atoi(o.Arg)
+			s.commitFails = append(s.commitFails, status)
+		} else {
+			s.script = append(s.script, o)
+		}
+	}
+}
+
+// Buffered returns every document buffered so far
+func (s *solrFake) Buffered() []FakeBuffered {
+	s.Lock()
+	defer s.Unlock()
+	return append([]FakeBuffered{}, s.buffered...)
+}
+
+// Added returns the ids of the documents added, one entry per successful (or partially successful) add
+func (s *solrFake) Added() [][]string {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]string{}, s.added...)
+}
+
+// Commits returns the number of successful commits
+func (s *solrFake) Commits() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.commits
+}
+
+func (s *solrFake) BufferDoc(id string, mode string, doc []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.pending) == 0 {
+		s.lastAdd = time.Now()
+	}
+
+	b := FakeBuffered{Id: id, Mode: mode, Payload: append([]byte{}, doc...)}
+	s.buffered = append(s.buffered, b)
+	s.pending = append(s.pending, b)
+	return nil
+}
+
+func (s *solrFake) ClearBuffer() {
+	s.Lock()
+	defer s.Unlock()
+	s.pending = s.pending[:0]
+}
+
+func (s *solrFake) IsAlive() error {
+	return nil
+}
+
+func (s *solrFake) LastError() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastError
+}
+
+func (s *solrFake) IsTimeToAdd() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.pending) == 0 {
+		return false
+	}
+
+	if uint(len(s.pending)) >= s.Config.SolrBlockCount {
+		return true
+	}
+
+	return time.Since(s.lastAdd) > time.Duration(s.Config.SolrFlushTime)*time.Second
+}
+
+func (s *solrFake) IsTimeToCommit() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.solrDirty == false || s.Config.SolrCommitTime == 0 {
+		return false
+	}
+
+	return time.Since(s.lastCommit) > time.Duration(s.Config.SolrCommitTime)*time.Second
+}
+
+func (s *solrFake) ForceAdd() (AddResult, error) {
+
+	if s.gate != nil {
+		<-s.gate
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// nothing to add
+	if len(s.pending) == 0 {
+		return AddResult{}, nil
+	}
+
+	// the next scripted outcome
+	outcome := FakeOutcome{Kind: "ok"}
+	if len(s.script) != 0 {
+		outcome = s.script[0]
+		s.script = s.script[1:]
+	}
+
+	log.Printf("worker %d: FAKE sending %d documents (outcome %s:%s)", s.workerId, len(s.pending), outcome.Kind, outcome.Arg)
+
+	s.lastError = ""
+	switch outcome.Kind {
+	case "ok":
+		s.recordAdd(len(s.pending))
+		return AddResult{}, nil
+
+	case "faildoc":
+		docNum, _ := strconv.Atoi(outcome.Arg)
+		s.lastError = fmt.Sprintf("FAKE: document number failure at [%d,1]", docNum)
+		s.recordAdd(docNum - 1)
+		return AddResult{FailedDoc: outcome.Arg}, ErrDocumentAdd
+
+	case "rejectid":
+		s.lastError = fmt.Sprintf("FAKE: ERROR: [doc=%s] rejected", outcome.Arg)
+		s.pending = s.pending[:0]
+		return AddResult{FailedDoc: outcome.Arg}, ErrAllDocumentAdd
+
+	case "rejectdoc":
+		s.lastError = fmt.Sprintf("FAKE: all documents rejected at [%s,1]", outcome.Arg)
+		s.pending = s.pending[:0]
+		return AddResult{FailedDoc: outcome.Arg}, ErrAllDocumentAdd
+
+	case "reject":
+		s.lastError = "FAKE: all documents rejected"
+		s.pending = s.pending[:0]
+		return AddResult{}, ErrAllDocumentAdd
+
+	case "conflict":
+		s.lastError = fmt.Sprintf("FAKE: user version is not high enough for %s", outcome.Arg)
+		s.pending = s.pending[:0]
+		return AddResult{FailedDoc: outcome.Arg}, ErrVersionConflict
+
+	case "panic":
+		panic("FAKE: add panic")
+
+	case "errors":
+		var result AddResult
+		failed := make(map[string]bool)
+		for _, id := range strings.Split(outcome.Arg, ";") {
+			failed[id] = true
+			result.Errors = append(result.Errors, DocumentError{Id: id, Message: fmt.Sprintf("FAKE: ERROR: [doc=%s] rejected", id)})
+		}
+		s.recordAddExcept(failed)
+		return result, nil
+
+	// the buffer is retained, as it is for the real implementation
+	default:
+		status, _ := strconv.Atoi(outcome.Arg)
+		s.lastError = fmt.Sprintf("FAKE: HTTP %d", status)
+		return AddResult{}, &HttpStatusError{StatusCode: status}
+	}
+}
+
+func (s *solrFake) ForceCommit() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.solrDirty == false {
+		return nil
+	}
+
+	if len(s.commitFails) != 0 {
+		status := s.commitFails[0]
+		s.commitFails = s.commitFails[1:]
+		s.lastError = fmt.Sprintf("FAKE: commit HTTP %d", status)
+		return &HttpStatusError{StatusCode: status}
+	}
+
+	s.commits++
+	s.lastCommit = time.Now()
+	s.solrDirty = false
+	return nil
+}
+
+// record the first count pending documents as added and clear the pending list
+func (s *solrFake) recordAdd(count int) {
+
+	if count > len(s.pending) {
+		count = len(s.pending)
+	}
+
+	ids := make([]string, 0, count)
+	for _, p := range s.pending[:max(count, 0)] {
+		ids = append(ids, p.Id)
+	}
+	s.recordAdded(ids)
+}
+
+// record the pending documents other than the failed ones as added and clear the pending list
+func (s *solrFake) recordAddExcept(failed map[string]bool) {
+
+	ids := make([]string, 0, len(s.pending))
+	for _, p := range s.pending {
+		if failed[p.Id] == false {
+			ids = append(ids, p.Id)
+		}
+	}
+	s.recordAdded(ids)
+}
+
+// record the documents as added and clear the pending list
+func (s *solrFake) recordAdded(ids []string) {
+
+	if len(ids) > 0 {
+		s.added = append(s.added, ids)
+
+		if s.solrDirty == false {
+			s.lastCommit = time.Now()
+		}
+		s.solrDirty = true
+	}
+
+	s.pending = s.pending[:0]
+	s.lastAdd = time.Now()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// the wire format used to talk to SOLR. An update request is made up of one or more command blocks, each
+// containing one or more documents
+type solrFormat interface {
+	ContentType() string                                                     // the update request content type
+	UrlParams() url.Values                                                   // any additional update request URL parameters
+	Open() []byte                                                            // the start of an update request
+	BeginCommand(mode string, commitWithin int) []byte                       // the start of a command block
+	Document(mode string, commitWithin int, first bool, doc []byte) [][]byte // a single document, the payload is not copied
+	EndCommand(mode string) []byte                                           // the end of a command block
+	Close() []byte                                                           // the end of an update request
+	Commit() []byte                                                          // a commit request
+	ParseResponse(body []byte) (solrResponse, error)                         // extract the interesting parts of a response
+}
+
+// the parts of a SOLR response we are interested in
+type solrResponse struct {
+	Status  int             // the response status, non-zero for errors
+	QTime   int             // the time SOLR spent processing the request (in milliseconds)
+	Message string          // any error message
+	Errors  []DocumentError // the failing documents reported by a tolerant update chain
+}
+
+// create the wire format for the specified name
+func newSolrFormat(name string) (solrFormat, error) {
+
+	switch name {
+	case "xml":
+		return &xmlFormat{}, nil
+	case "json":
+		return &jsonFormat{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported SOLR format [%s]", name)
+}
+
+//
+// the XML update format
+//
+
+type xmlFormat struct{}
+
+func (f *xmlFormat) ContentType() string {
+	return "application/xml"
+}
+
+func (f *xmlFormat) UrlParams() url.Values {
+	return url.Values{}
+}
+
+// multiple command blocks are wrapped in a single update element
+func (f *xmlFormat) Open() []byte {
+	return []byte("<update>")
+}
+
+func (f *xmlFormat) BeginCommand(mode string, commitWithin int) []byte {
+
+	// if we are doing client side commit withins
+	if commitWithin != 0 {
+		// commit within time is specified in milliseconds
+		return []byte(fmt.Sprintf("<%s commitWithin=\"%d\">", mode, commitWithin*1000))
+	}
+	return []byte(fmt.Sprintf("<%s>", mode))
+}
+
+func (f *xmlFormat) Document(mode string, commitWithin int, first bool, doc []byte) [][]byte {
+	return [][]byte{doc}
+}
+
+func (f *xmlFormat) EndCommand(mode string) []byte {
+	return []byte(fmt.Sprintf("</%s>", mode))
+}
+
+func (f *xmlFormat) Close() []byte {
+	return []byte("</update>")
+}
+
+func (f *xmlFormat) Commit() []byte {
+	return []byte("<commit/>")
+}
+
+func (f *xmlFormat) ParseResponse(body []byte) (solrResponse, error) {
+
+	var response solrResponse
+
+	// generate a query structure from the body
+	doc, err := xmlquery.Parse(bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+
+	// attempt to extract the statusNode field
+	statusNode := xmlquery.FindOne(doc, "//response/lst[@name='responseHeader']/int[@name='status']")
+	if statusNode == nil {
+		return response, fmt.Errorf("cannot find status field in response payload (%s)", body)
+	}
+
+	response.Status, _ = strconv.Atoi(statusNode.InnerText())
+
+	// and the QTime if there is one
+	qtimeNode := xmlquery.FindOne(doc, "//response/lst[@name='responseHeader']/int[@name='QTime']")
+	if qtimeNode != nil {
+		response.QTime, _ = strconv.Atoi(qtimeNode.InnerText())
+	}
+
+	// attempt to find the error message body
+	messageNode := xmlquery.FindOne(doc, "//response/lst[@name='error']/str[@name='msg']")
+	if messageNode != nil {
+		response.Message = messageNode.InnerText()
+	}
+
+	// and any errors reported by a tolerant update chain
+	for _, e := range xmlquery.Find(doc, "//response/lst[@name='responseHeader']/arr[@name='errors']/lst") {
+		var docError DocumentError
+		if idNode := xmlquery.FindOne(e, "str[@name='id']"); idNode != nil {
+			docError.Id = idNode.InnerText()
+		}
+		if msgNode := xmlquery.FindOne(e, "str[@name='message']"); msgNode != nil {
+			docError.Message = msgNode.InnerText()
+		}
+		response.Errors = append(response.Errors, docError)
+	}
+
+	return response, nil
+}
+
+//
+// the JSON update format, we use the command object form so that we can specify commitWithin and deletes
+// for each document. For example:
+//
+// {"add":{"commitWithin":5000,"doc":{"id":"1"}},"delete":{"id":"2"}}
+//
+
+type jsonFormat struct{}
+
+// the parts of a SOLR JSON response we are interested in
+type jsonResponse struct {
+	ResponseHeader *struct {
+		Status int `json:"status"`
+		QTime  int `json:"QTime"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Id      string `json:"id"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"responseHeader"`
+	Error *struct {
+		Msg  string `json:"msg"`
+		Code int    `json:"code"`
+	} `json:"error"`
+}
+
+func (f *jsonFormat) ContentType() string {
+	return "application/json"
+}
+
+func (f *jsonFormat) UrlParams() url.Values {
+	return url.Values{"wt": []string{"json"}}
+}
+
+func (f *jsonFormat) Open() []byte {
+	return []byte("{")
+}
+
+func (f *jsonFormat) BeginCommand(mode string, commitWithin int) []byte {
+	// every document is a separate command
+	return []byte{}
+}
+
+func (f *jsonFormat) Document(mode string, commitWithin int, first bool, doc []byte) [][]byte {
+
+	var buf bytes.Buffer
+	if first == false {
+		buf.WriteString(",")
+	}
+
+	doc = bytes.TrimSpace(doc)
+
+	if mode == "delete" {
+
+		// the payload is either a delete object or the bare id to delete
+		if len(doc) != 0 && doc[0] == '{' {
+			buf.WriteString("\"delete\":")
+			return [][]byte{buf.Bytes(), doc}
+		}
+
+		// the id may or may not be quoted
+		id := string(doc)
+		if unquoted, err := strconv.Unquote(id); err == nil {
+			id = unquoted
+		}
+		quoted, _ := json.Marshal(id)
+		buf.WriteString("\"delete\":{\"id\":")
+		buf.Write(quoted)
+		if commitWithin != 0 {
+			buf.WriteString(fmt.Sprintf(",\"commitWithin\":%d", commitWithin*1000))
+		}
+		buf.WriteString("}")
+		return [][]byte{buf.Bytes()}
+	}
+
+	buf.WriteString(fmt.Sprintf("\"%s\":{", mode))
+	if commitWithin != 0 {
+		buf.WriteString(fmt.Sprintf("\"commitWithin\":%d,", commitWithin*1000))
+	}
+	buf.WriteString("\"doc\":")
+	return [][]byte{buf.Bytes(), doc, []byte("}")}
+}
+
+func (f *jsonFormat) EndCommand(mode string) []byte {
+	return []byte{}
+}
+
+func (f *jsonFormat) Close() []byte {
+	return []byte("}")
+}
+
+func (f *jsonFormat) Commit() []byte {
+	return []byte("{\"commit\":{}}")
+}
+
+func (f *jsonFormat) ParseResponse(body []byte) (solrResponse, error) {
+
+	var response solrResponse
+	var payload jsonResponse
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return response, err
+	}
+
+	if payload.ResponseHeader == nil {
+		return response, fmt.Errorf("cannot find status field in response payload (%s)", body)
+	}
+
+	response.Status = payload.ResponseHeader.Status
+	response.QTime = payload.ResponseHeader.QTime
+	if payload.Error != nil {
+		response.Message = payload.Error.Msg
+	}
+	for _, e := range payload.ResponseHeader.Errors {
+		response.Errors = append(response.Errors, DocumentError{Id: e.Id, Message: e.Message})
+	}
+
+	return response, nil
+}
+
+//
+// end of file
+//
@@ -2,19 +2,31 @@ package main
 
 // SOLR - our SOLR interface
 type SOLR interface {
-	BufferDoc(string, []byte) error // add a document to the buffer in preparation to send to SOLR
-	IsAlive() error                 // is our endpoint alive?
-	IsTimeToAdd() bool              // is it time to add our pending documents
-	IsTimeToCommit() bool           // is it time to commit?
-	ForceAdd() (string, error)      // force an add for pending documents (returns document number of any failing item)
-	ForceCommit() error             // force a commit
+	BufferDoc(string, string, []byte) error // add a document (id, operation, payload) to the buffer in preparation to send to SOLR
+	ClearBuffer()                           // discard the buffered documents
+	IsAlive() error                         // is our endpoint alive?
+	IsTimeToAdd() bool                      // is it time to add our pending documents
+	IsTimeToCommit() bool                   // is it time to commit?
+	ForceAdd() (AddResult, error)           // force an add for pending documents (returns the details of any failing items)
+	ForceCommit() error                     // force a commit
+	LastError() string                      // the most recent error message reported by SOLR
 }
 
-// NewSolr - Initialize our SOLR connection
-func NewSolr(id int, config ServiceConfig) (SOLR, error) {
+// AddResult - the details of any failing documents reported by SOLR when adding the pending documents
+type AddResult struct {
+	FailedDoc string          // the failing document number or id (ErrDocumentAdd, ErrAllDocumentAdd and ErrVersionConflict)
+	Errors    []DocumentError // the failing documents reported by a tolerant update chain, the others were added
+}
+
+// DocumentError - a single failing document reported by a tolerant update chain
+type DocumentError struct {
+	Id      string // the document id
+	Message string // the error message
+}
 
-	// mock implementation here if necessary
-	return newSolr(id, config)
+// NewSolr - Initialize our SOLR connection, retries are abandoned once stop is closed
+func NewSolr(id int, config ServiceConfig, stop <-chan struct{}) (SOLR, error) {
+	return newSolr(id, config, stop)
 }
 
 //
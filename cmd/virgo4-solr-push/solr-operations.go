@@ -1,45 +1,87 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func (s *solrImpl) BufferDoc(id string, doc []byte) error {
+func (s *solrImpl) BufferDoc(id string, mode string, doc []byte) error {
 
 	// if we have not yet added any documents
 	if s.pendingAdds == 0 {
 
-		// create the open tag for the command
-		tag := fmt.Sprintf("<%s>", s.Config.SolrMode)
-
-		// if we are doing client side commit withins
-		if s.Config.SolrCommitWithinTime != 0 {
-			// commit within time is specified in milliseconds
-			tag = fmt.Sprintf("<%s commitWithin=\"%d\">", s.Config.SolrMode, s.Config.SolrCommitWithinTime*1000)
-		}
-
-		s.addBuffer = append(s.addBuffer, []byte(tag)...)
+		// open the request and the command block
+		s.appendSegments(s.format.Open(), s.format.BeginCommand(mode, s.Config.SolrCommitWithinTime))
+		s.pendingMode = mode
 
 		// we are only interested in tracking the time for the last add after the first document is actually
 		// added to the buffer
 		s.lastAdd = time.Now()
 	}
 
+	// if the operation has changed, close the current command block and open a new one. This keeps the
+	// documents in the order they were buffered
+	if mode != s.pendingMode {
+		s.appendSegments(s.format.EndCommand(s.pendingMode), s.format.BeginCommand(mode, s.Config.SolrCommitWithinTime))
+		s.pendingMode = mode
+	}
+
 	// add the document and the identifier (for logging) and update the document count
-	s.addBuffer = append(s.addBuffer, doc...)
+	s.appendSegments(s.format.Document(mode, s.Config.SolrCommitWithinTime, s.pendingAdds == 0, doc)...)
 	s.pendingAddIds = append(s.pendingAddIds, id)
 	s.pendingAdds++
+	s.updatePendingGauge()
 
 	return nil
 }
 
+func (s *solrImpl) ClearBuffer() {
+
+	s.clearPending()
+	s.updatePendingGauge()
+}
+
+// add segments to the buffered request and account for them in the memory budget
+func (s *solrImpl) appendSegments(segments ...[]byte) {
+
+	size := 0
+	for _, segment := range segments {
+		if len(segment) != 0 {
+			s.pendingBody = append(s.pendingBody, segment)
+			size += len(segment)
+		}
+	}
+	s.pendingBytes += size
+	if s.budget != nil {
+		s.budget.reserve(size)
+	}
+}
+
+// discard the buffered request and release its memory
+func (s *solrImpl) clearPending() {
+
+	if s.budget != nil {
+		s.budget.release(s.pendingBytes)
+	}
+
+	// do not keep references to the documents
+	clear(s.pendingBody)
+	s.pendingBody = s.pendingBody[:0]
+	s.pendingBytes = 0
+	s.pendingAddIds = s.pendingAddIds[:0]
+	s.pendingAdds = 0
+}
+
 func (s *solrImpl) IsAlive() error {
 	return s.protocolPing()
 }
 
+func (s *solrImpl) LastError() string {
+	return s.lastError
+}
+
 func (s *solrImpl) IsTimeToAdd() bool {
 
 	// if we have no pending adds then no add is required
@@ -52,17 +94,22 @@ func (s *solrImpl) IsTimeToAdd() bool {
 	// if we have pending items and we have not added in the configured number of seconds
 	//
 
-	if s.pendingAdds >= s.Config.SolrBlockCount {
+	if s.pendingAdds >= s.sizer.blockCount() {
 		log.Printf("worker %d: reached send block count", s.workerId)
 		return true
 	}
 
-	if len(s.addBuffer) >= int(s.sendBufferSize) {
+	if s.pendingBytes >= int(s.sendBufferSize) {
 		log.Printf("worker %d: reached send buffer size", s.workerId)
 		return true
 	}
 
-	if time.Since(s.lastAdd).Seconds() > (time.Duration(s.Config.SolrFlushTime) * time.Second).Seconds() {
+	if s.budget != nil && s.budget.exceeded() == true {
+		log.Printf("worker %d: reached memory budget", s.workerId)
+		return true
+	}
+
+	if time.Since(s.lastAdd) > s.sizer.flushTime() {
 		log.Printf("worker %d: reached send timeout", s.workerId)
 		return true
 	}
@@ -90,29 +137,44 @@ func (s *solrImpl) IsTimeToCommit() bool {
 	return time.Since(s.lastCommit).Seconds() > (time.Duration(s.Config.SolrCommitTime) * time.Second).Seconds()
 }
 
-func (s *solrImpl) ForceAdd() (string, error) {
+func (s *solrImpl) ForceAdd() (AddResult, error) {
 
 	// nothing to add
 	if s.pendingAdds == 0 {
-		return "", nil
+		return AddResult{}, nil
 	}
 
-	tag := fmt.Sprintf("</%s>", s.Config.SolrMode)
-	s.addBuffer = append(s.addBuffer, []byte(tag)...)
-	log.Printf("worker %d: sending %d documents to SOLR (buffer %d bytes)", s.workerId, s.pendingAdds, len(s.addBuffer))
+	// close the command block and the request. The buffered request is left open in case we need to send
+	// the documents again
+	body := append(s.pendingBody[:len(s.pendingBody):len(s.pendingBody)], s.format.EndCommand(s.pendingMode), s.format.Close())
+	log.Printf("worker %d: sending %d documents to SOLR (request %d bytes)", s.workerId, s.pendingAdds, body.size())
 	log.Printf("worker %d: ids: %s", s.workerId, strings.Join(s.pendingAddIds, " "))
 
 	// add to SOLR
 	start := time.Now()
-	failedDoc, err := s.protocolAdd(s.addBuffer)
+	s.roundTrip = 0
+	result, err := s.protocolAdd(body)
 	duration := time.Since(start)
 
+	dest := s.Config.DestinationName
+	addLatency.WithLabelValues(dest).Observe(duration.Seconds())
+	batchDocuments.WithLabelValues(dest).Observe(float64(s.pendingAdds))
+	batchBytes.WithLabelValues(dest).Observe(float64(body.size()))
+
+	// failing documents say nothing about how SOLR is coping. Only the last attempt tells us how long SOLR took,
+	// waiting for the limiter and between retries does not
+	if s.roundTrip != 0 {
+		s.sizer.observe(s.pendingAdds, s.roundTrip, err != nil && err != ErrDocumentAdd && err != ErrAllDocumentAdd && err != ErrVersionConflict)
+	}
+	defer s.updatePendingGauge()
+
 	switch err {
 
 	// no error
 	case nil:
 
-		log.Printf("worker %d: added %d documents in %0.2f seconds", s.workerId, s.pendingAdds, duration.Seconds())
+		log.Printf("worker %d: added %d documents in %0.2f seconds", s.workerId, s.pendingAdds-uint(len(result.Errors)), duration.Seconds())
+		documentsAdded.WithLabelValues(dest).Add(float64(s.pendingAdds - uint(len(result.Errors))))
 
 		// only start timing for a SOLR commit after SOLR becomes dirty
 		if s.solrDirty == false {
@@ -123,18 +185,22 @@ func (s *solrImpl) ForceAdd() (string, error) {
 		s.solrDirty = true
 
 		// clear the buffer and other state variables
-		s.addBuffer = s.addBuffer[:0]
-		s.pendingAddIds = s.pendingAddIds[:0]
-		s.pendingAdds = 0
+		s.clearPending()
 		s.lastAdd = time.Now()
 
-		return "", nil
+		return result, nil
 
 	// one of the documents added failed
 	case ErrDocumentAdd:
 
 		log.Printf("worker %d: added some documents in %0.2f seconds", s.workerId, duration.Seconds())
 
+		// the documents before the failed one were added, the remainder will be buffered again
+		failedNum, _ := strconv.Atoi(result.FailedDoc)
+		if failedNum > 1 {
+			documentsAdded.WithLabelValues(dest).Add(float64(failedNum - 1))
+		}
+
 		// only start timing for a SOLR commit after SOLR becomes dirty
 		if s.solrDirty == false {
 			s.lastCommit = time.Now()
@@ -144,12 +210,10 @@ func (s *solrImpl) ForceAdd() (string, error) {
 		s.solrDirty = true
 
 		// clear the buffer and other state variables
-		s.addBuffer = s.addBuffer[:0]
-		s.pendingAddIds = s.pendingAddIds[:0]
-		s.pendingAdds = 0
+		s.clearPending()
 		s.lastAdd = time.Now()
 
-		return failedDoc, ErrDocumentAdd
+		return result, ErrDocumentAdd
 
 	// all the document adds failed
 	case ErrAllDocumentAdd:
@@ -157,16 +221,24 @@ func (s *solrImpl) ForceAdd() (string, error) {
 		log.Printf("worker %d: added no documents in %0.2f seconds", s.workerId, duration.Seconds())
 
 		// clear the buffer and other state variables
-		s.addBuffer = s.addBuffer[:0]
-		s.pendingAddIds = s.pendingAddIds[:0]
-		s.pendingAdds = 0
+		s.clearPending()
 		//s.lastAdd = time.Now()
 
-		return failedDoc, ErrAllDocumentAdd
+		return result, ErrAllDocumentAdd
 
-	// some other error, just return it
+	// a newer copy of one of the documents is already indexed
+	case ErrVersionConflict:
+
+		log.Printf("worker %d: added no documents in %0.2f seconds", s.workerId, duration.Seconds())
+
+		// clear the buffer and other state variables
+		s.clearPending()
+
+		return result, ErrVersionConflict
+
+	// some other error, the documents remain buffered
 	default:
-		return failedDoc, err
+		return result, err
 	}
 }
 
@@ -188,6 +260,8 @@ func (s *solrImpl) ForceCommit() error {
 		return err
 	}
 
+	commitLatency.WithLabelValues(s.Config.DestinationName).Observe(duration.Seconds())
+
 	log.Printf("worker %d: commit completed in %0.2f seconds", s.workerId, duration.Seconds())
 
 	// update state variables
@@ -197,6 +271,11 @@ func (s *solrImpl) ForceCommit() error {
 	return nil
 }
 
+// report the number of buffered documents
+func (s *solrImpl) updatePendingGauge() {
+	pendingDocuments.WithLabelValues(strconv.Itoa(s.workerId), s.Config.DestinationName).Set(float64(s.pendingAdds))
+}
+
 //
 // end of file
 //
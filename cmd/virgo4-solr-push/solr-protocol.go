@@ -1,29 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"regexp"
-	"strconv"
-
-	"github.com/antchfx/xmlquery"
 )
 
-var maxHttpRetries = 3
-var retrySleepTime = 100 * time.Millisecond
-
 var ErrDocumentAdd = fmt.Errorf("single document add failed")
 var ErrAllDocumentAdd = fmt.Errorf("all document add failed")
 
+// requests smaller than this are not worth compressing
+var gzipMinSize = 1024
+
 func (s *solrImpl) protocolCommit() error {
 
-	body, err := s.httpPost([]byte("<commit/>"))
+	body, err := s.httpPost(requestBody{s.format.Commit()})
 	if err != nil {
 		return err
 	}
@@ -40,191 +36,255 @@ func (s *solrImpl) protocolCommit() error {
 func (s *solrImpl) protocolPing() error {
 
 	_, err := s.httpGet(s.PingUrl)
+	if err != nil {
+		s.breaker.failure(err)
+	} else {
+		s.breaker.success()
+	}
 	return err
 }
 
-func (s *solrImpl) protocolAdd(buffer []byte) (string, error) {
+func (s *solrImpl) protocolAdd(request requestBody) (AddResult, error) {
 
-	body, err := s.httpPost(buffer)
+	var result AddResult
+	s.lastError = ""
+	body, err := s.httpPost(request)
 
 	switch err {
 
 	// no error, we need to look at the body to determine if there were specific document failures
 	case nil:
 
-		var docNum string
-		_, docNum, err = s.processResponsePayload(body)
+		var response solrResponse
+		response, result.FailedDoc, err = s.processResponsePayload(body)
 		if err != nil {
 
+			// a newer copy of one of the documents is already indexed
+			if err == ErrVersionConflict {
+				return result, err
+			}
+
 			// one of the documents in the add list failed
-			if err == ErrDocumentAdd && len(docNum) != 0 {
-				log.Printf("worker %d: ERROR add document number %s FAILED", s.workerId, docNum)
-				return docNum, err
+			if err == ErrDocumentAdd && len(result.FailedDoc) != 0 {
+				log.Printf("worker %d: ERROR add document number %s FAILED", s.workerId, result.FailedDoc)
+				return result, err
 			}
 
-			return "", err
+			return AddResult{}, err
 		}
+
+		// a tolerant update chain reports the failing documents and adds the others
+		result.Errors = response.Errors
+		for _, e := range result.Errors {
+			log.Printf("worker %d: ERROR add document id %s FAILED (%s)", s.workerId, e.Id, e.Message)
+		}
+
 		// all good
-		return "", nil
+		return result, nil
 
 	// all the adds failed, the body will tell us which document ID is the problem
 	case ErrAllDocumentAdd:
 
-		// we ignore the error from this call because we have already decided that all the documents have failed
-		_, docNum, _ := s.processResponsePayload(body)
+		// we ignore the error from this call because we have already decided that all the documents have failed.
+		// If a tolerant update chain exceeded the maximum errors, it tells us about all of the failures
+		response, docNum, perr := s.processResponsePayload(body)
+		if perr == ErrVersionConflict {
+			log.Printf("worker %d: INFO version conflict for id/doc number %s, a newer copy is already indexed", s.workerId, docNum)
+			return AddResult{FailedDoc: docNum}, ErrVersionConflict
+		}
 		if len(docNum) != 0 {
 			log.Printf("worker %d: WARNING all documents rejected due to id/doc number %s", s.workerId, docNum)
 		}
-		return docNum, ErrAllDocumentAdd
+		return AddResult{FailedDoc: docNum, Errors: response.Errors}, ErrAllDocumentAdd
 
 	default:
-		return "", err
+		return AddResult{}, err
 	}
 }
 
 func (s *solrImpl) httpGet(url string) ([]byte, error) {
+	return s.httpDo("GET", url, nil)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// post the buffer to SOLR and report the outcome to the circuit breaker. SOLR is available if it answers,
+// even if it rejects the documents, and we say nothing about it if we gave up before asking
+func (s *solrImpl) httpPost(request requestBody) ([]byte, error) {
+
+	body, err := s.httpPostAttempts(request)
+	if err == ErrShuttingDown {
+		return body, err
 	}
+	if err != nil && err != ErrAllDocumentAdd {
+		s.breaker.failure(err)
+	} else {
+		s.breaker.success()
+	}
+	return body, err
+}
 
-	var response *http.Response
-	count := 0
-	for {
-		response, err = s.httpClient.Do(req)
+func (s *solrImpl) httpPostAttempts(request requestBody) ([]byte, error) {
 
-		count++
-		if err != nil {
-			if s.canRetry(err) == false {
-				return nil, err
-			}
+	body, err := s.httpDo("POST", s.PostUrl, request)
 
-			// break when tried too many times
-			if count >= maxHttpRetries {
-				return nil, err
-			}
+	// this is a special case where SOLR rejects all documents (a conflict is a stale document version)
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) == true && (statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusConflict) {
+		return body, ErrAllDocumentAdd
+	}
 
-			log.Printf("worker %d: ERROR GET failed with error, retrying (%s)", s.workerId, err)
+	return body, err
+}
 
-			// sleep for a bit before retrying
-			time.Sleep(retrySleepTime)
-		} else {
+// make the request, retrying according to our retry policy. Each attempt streams the request again so there
+// is never a second copy of it. Returns the response body along with any error so the caller can look at
+// the details
+func (s *solrImpl) httpDo(method string, url string, request requestBody) ([]byte, error) {
 
-			defer response.Body.Close()
+	encoding := s.bodyEncoding(request)
 
-			body, err := ioutil.ReadAll(response.Body)
+	attempt := 0
+	for {
+		attempt++
+		body, err := s.limitedAttempt(method, url, request, encoding)
+		if err == nil {
+			return body, nil
+		}
 
-			// happy day, hopefully all is well
-			if response.StatusCode == http.StatusOK {
+		// if SOLR does not accept compressed requests, stop compressing and send it again
+		var unsupported *HttpStatusError
+		if len(encoding) != 0 && errors.As(err, &unsupported) == true && unsupported.StatusCode == http.StatusUnsupportedMediaType {
+			log.Printf("worker %d: WARNING SOLR does not accept %s requests, disabling compression", s.workerId, encoding)
+			s.gzip = false
+			encoding = ""
+			attempt--
+			continue
+		}
 
-				// if the body read failed
-				if err != nil {
-					log.Printf("worker %d: ERROR read failed with error (%s)", s.workerId, err)
-					return nil, err
-				}
+		// break when the error cannot be retried or we have tried too many times
+		if s.retry.canRetry(err) == false || attempt >= s.retry.attempts {
+			return body, err
+		}
 
-				return body, nil
-			}
+		var retryAfter time.Duration
+		var statusErr *HttpStatusError
+		if errors.As(err, &statusErr) == true {
+			retryAfter = statusErr.RetryAfter
+		}
 
-			log.Printf("worker %d: ERROR GET failed with status %d (%s)", s.workerId, response.StatusCode, body)
+		delay := s.retry.delay(attempt, retryAfter)
+		log.Printf("worker %d: WARNING %s failed, retrying in %s (%s)", s.workerId, method, delay, err)
 
-			return body, fmt.Errorf("request returns HTTP %d", response.StatusCode)
+		// sleep for a bit before retrying, unless we are shutting down
+		select {
+		case <-s.stop:
+			log.Printf("worker %d: WARNING shutting down, abandoning %s retries", s.workerId, method)
+			return body, err
+		case <-time.After(delay):
 		}
 	}
 }
 
-func (s *solrImpl) httpPost(buffer []byte) ([]byte, error) {
+// make a single request, update and commit requests wait until the destination's request limit allows them
+func (s *solrImpl) limitedAttempt(method string, url string, request requestBody, encoding string) ([]byte, error) {
 
-	var response *http.Response
-	count := 0
-
-	for {
-		req, err := http.NewRequest("POST", s.PostUrl, bytes.NewBuffer(buffer))
-		if err != nil {
-			return nil, err
-		}
-
-		req.Header.Set("Content-Type", "application/xml")
+	if request == nil {
+		return s.httpAttempt(method, url, request, encoding)
+	}
 
-		response, err = s.httpClient.Do(req)
-		count++
-		if err != nil {
-			if s.canRetry(err) == false {
-				return nil, err
-			}
+	started, err := s.limiter.acquire(s.workerId, s.stop)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.httpAttempt(method, url, request, encoding)
+	s.limiter.release(started, err)
+	s.roundTrip = time.Since(started)
+	return body, err
+}
 
-			// break when tried too many times
-			if count >= maxHttpRetries {
-				return nil, err
-			}
+// make a single request
+func (s *solrImpl) httpAttempt(method string, url string, request requestBody, encoding string) ([]byte, error) {
 
-			log.Printf("worker %d: WARNING POST failed with error, retrying (%s)", s.workerId, err)
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
 
-			// sleep for a bit before retrying
-			time.Sleep(retrySleepTime)
-		} else {
+	if request != nil {
 
-			defer response.Body.Close()
+		// the client asks for the body again if it needs to resend it
+		req.GetBody = func() (io.ReadCloser, error) {
+			return s.bodyStream(request, encoding), nil
+		}
+		req.Body, _ = req.GetBody()
 
-			body, err := ioutil.ReadAll(response.Body)
+		// we do not know the size of a compressed body until we have sent it
+		if len(encoding) == 0 {
+			req.ContentLength = int64(request.size())
+		}
 
-			// happy day, hopefully all is well
-			if response.StatusCode == http.StatusOK {
+		req.Header.Set("Content-Type", s.format.ContentType())
+		if len(encoding) != 0 {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+	}
 
-				// if the body read failed
-				if err != nil {
-					log.Printf("worker %d: ERROR read failed with error (%s)", s.workerId, err)
-					return nil, err
-				}
+	response, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
 
-				// everything went OK
-				return body, nil
-			}
+	body, err := io.ReadAll(response.Body)
 
-			log.Printf("worker %d: ERROR POST failed with status %d (%s)", s.workerId, response.StatusCode, body)
+	// happy day, hopefully all is well
+	if response.StatusCode == http.StatusOK {
 
-			// this is a special case where SOLR rejects all documents
-			if response.StatusCode == http.StatusBadRequest {
-				return body, ErrAllDocumentAdd
-			} else {
-				return body, fmt.Errorf("request returns HTTP %d", response.StatusCode)
-			}
+		// if the body read failed
+		if err != nil {
+			log.Printf("worker %d: ERROR read failed with error (%s)", s.workerId, err)
+			return nil, err
 		}
+
+		return body, nil
 	}
+
+	log.Printf("worker %d: ERROR %s failed with status %d (%s)", s.workerId, method, response.StatusCode, body)
+	return body, &HttpStatusError{StatusCode: response.StatusCode, RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"))}
 }
 
-func (s *solrImpl) processResponsePayload(body []byte) (int, string, error) {
+func (s *solrImpl) processResponsePayload(body []byte) (solrResponse, string, error) {
 
-	// generate a query structure from the body
-	doc, err := xmlquery.Parse(bytes.NewReader(body))
+	// extract the status and any error message using the configured wire format
+	response, err := s.format.ParseResponse(body)
 	if err != nil {
-		return 0, "", err
+		return response, "", err
 	}
 
-	// attempt to extract the statusNode field
-	statusNode := xmlquery.FindOne(doc, "//response/lst[@name='responseHeader']/int[@name='status']")
-	if statusNode == nil {
-		return 0, "", fmt.Errorf("cannot find status field in response payload (%s)", body)
-	}
+	solrQTime.WithLabelValues(s.Config.DestinationName).Observe(float64(response.QTime) / 1000)
+	status, message := response.Status, response.Message
 
 	// if it appears that we have an error
-	if statusNode.InnerText() != "0" {
+	if status != 0 {
 
-		// extract the status and attempt to find the error messageNode body
-		status, _ := strconv.Atoi(statusNode.InnerText())
+		if len(message) != 0 {
 
-		messageNode := xmlquery.FindOne(doc, "//response/lst[@name='error']/str[@name='msg']")
-		if messageNode != nil {
+			// keep the error message so it can be reported along with any rejected documents
+			s.lastError = message
+
+			// if a newer version of the document is already indexed, that is not a failure. Any other conflict
+			// is handled like any other rejection
+			if isVersionConflict(message) == true {
+				return response, "", ErrVersionConflict
+			}
 
 			// if this is an error on a specific document number, we try to extract that information
 
 			re := regexp.MustCompile(`\[(\d+),\d+\]`)
-			match := re.FindStringSubmatch(messageNode.InnerText())
+			match := re.FindStringSubmatch(message)
 			if match != nil {
 				//fmt.Printf("%s", body)
 				// return the document number of failing item
-				return status, match[1], ErrDocumentAdd
+				return response, match[1], ErrDocumentAdd
 			}
 
 			// if this is an error on a specific document id, we try to extract that information
@@ -233,11 +293,11 @@ func (s *solrImpl) processResponsePayload(body []byte) (int, string, error) {
 			// <str name="msg">ERROR: [doc=as:3r617] Error adding field 'published_date'='1969' msg=Invalid Date String:'1969'</str>
 			//
 			re = regexp.MustCompile(`\[doc=(.+?)\]`)
-			match = re.FindStringSubmatch(messageNode.InnerText())
+			match = re.FindStringSubmatch(message)
 			if match != nil {
 				//fmt.Printf("%s", body)
 				// return document id of failing item
-				return status, match[1], ErrAllDocumentAdd
+				return response, match[1], ErrAllDocumentAdd
 			}
 
 			// kinda ad-hoc looking for other error cases
@@ -246,46 +306,22 @@ func (s *solrImpl) processResponsePayload(body []byte) (int, string, error) {
 			// <str name="msg">Exception writing document id as:3r617 to the index; possible analysis error: DocValuesField "sc_availability_stored" is too large, must be &lt;= 32766</str>
 			//
 			re = regexp.MustCompile(`document id (\S*)`)
-			match = re.FindStringSubmatch(messageNode.InnerText())
+			match = re.FindStringSubmatch(message)
 			if match != nil {
 				//fmt.Printf("%s", body)
 				// return document id of failing item
-				return status, match[1], ErrAllDocumentAdd
+				return response, match[1], ErrAllDocumentAdd
 			}
 
+		} else {
+			s.lastError = string(body)
 		}
 		log.Printf("ERROR extracting id/doc number from payload, please review the extract code and implement support for this error case")
-		return status, "", fmt.Errorf("%s", body)
+		return response, "", fmt.Errorf("%s", body)
 	}
 
 	// all good
-	return 0, "", nil
-}
-
-// examines the error and decides if if can be retried
-func (s *solrImpl) canRetry(err error) bool {
-
-	if strings.Contains(err.Error(), "operation timed out") == true {
-		return true
-	}
-
-	if strings.Contains(err.Error(), "Client.Timeout exceeded") == true {
-		return true
-	}
-
-	if strings.Contains(err.Error(), "write: broken pipe") == true {
-		return true
-	}
-
-	if strings.Contains(err.Error(), "no such host") == true {
-		return true
-	}
-
-	if strings.Contains(err.Error(), "network is down") == true {
-		return true
-	}
-
-	return false
+	return response, "", nil
 }
 
 //
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a SOLR implementation talking to a new emulator, the configuration can be adjusted before it is created
+func testSolr(t *testing.T, adjust func(*ServiceConfig)) (*solrImpl, *SolrEmulator) {
+
+	emu := NewSolrEmulator("test", defaultUniqueKey)
+	t.Cleanup(emu.Close)
+
+	config := testConfig()
+	config.SolrUrl = emu.URL()
+	config.HttpRetries = 1
+	if adjust != nil {
+		adjust(&config)
+	}
+
+	impl, err := newSolr(1, config, nil)
+	if err != nil {
+		t.Fatalf("cannot connect to the emulator: %s", err.Error())
+	}
+	return impl.(*solrImpl), emu
+}
+
+// buffer a document for each id
+func bufferDocs(t *testing.T, s SOLR, ids ...string) {
+
+	for _, id := range ids {
+		m := testMessage(id)
+		if err := s.BufferDoc(id, "add", m.Payload); err != nil {
+			t.Fatalf("buffer failed: %s", err.Error())
+		}
+	}
+}
+
+func TestSolrAdd(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		script    string
+		chain     string
+		err       error
+		failedDoc string
+		errors    []string
+		indexed   int
+	}{
+		{name: "all added", script: "ok", indexed: 3},
+		{name: "document number rejected", script: "rejectdoc:2", err: ErrAllDocumentAdd, failedDoc: "2"},
+		{name: "document id rejected", script: "rejectid:b", err: ErrAllDocumentAdd, failedDoc: "b"},
+		{name: "unidentified rejection", script: "reject", err: ErrAllDocumentAdd},
+		{name: "version conflict", script: "conflict:b", err: ErrVersionConflict},
+		{name: "other conflict", script: "http:409", err: ErrAllDocumentAdd},
+		{name: "tolerant update chain", script: "errors:a;c", chain: "tolerant", errors: []string{"a", "c"}, indexed: 1},
+		{name: "no update chain", script: "errors:a;c", err: ErrAllDocumentAdd, failedDoc: "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			s, emu := testSolr(t, func(c *ServiceConfig) {
+				c.SolrUpdateChain = test.chain
+				c.SolrMaxErrors = -1
+			})
+			if err := emu.Script(test.script); err != nil {
+				t.Fatalf("bad script: %s", err.Error())
+			}
+
+			bufferDocs(t, s, "a", "b", "c")
+			result, err := s.ForceAdd()
+
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if result.FailedDoc != test.failedDoc {
+				t.Errorf("expected failed doc [%s], got [%s]", test.failedDoc, result.FailedDoc)
+			}
+
+			failed := make([]string, 0)
+			for _, e := range result.Errors {
+				failed = append(failed, e.Id)
+			}
+			if len(test.errors) != 0 && reflect.DeepEqual(failed, test.errors) == false {
+				t.Errorf("expected errors for %v, got %v", test.errors, failed)
+			}
+			if emu.DocCount() != test.indexed {
+				t.Errorf("expected %d documents indexed, got %d", test.indexed, emu.DocCount())
+			}
+		})
+	}
+}
+
+func TestSolrAddJson(t *testing.T) {
+
+	s, emu := testSolr(t, func(c *ServiceConfig) {
+		c.SolrFormat = "json"
+		c.SolrUpdateChain = "tolerant"
+		c.SolrMaxErrors = -1
+	})
+	_ = emu.Script("errors:b")
+
+	for _, id := range []string{"a", "b", "c"} {
+		_ = s.BufferDoc(id, "add", []byte(fmt.Sprintf(`{"id":"%s"}`, id)))
+	}
+	_ = s.BufferDoc("a", "delete", []byte(`"a"`))
+
+	result, err := s.ForceAdd()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Id != "b" {
+		t.Errorf("expected an error for b, got %v", result.Errors)
+	}
+
+	// the delete is applied after the adds
+	if _, found := emu.Doc("c"); found == false || emu.DocCount() != 1 {
+		t.Errorf("expected only c to be indexed, got %d documents", emu.DocCount())
+	}
+}
+
+func TestSolrRetries(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		script  string
+		retries int
+		status  int // the HTTP status of the error, if any
+		updates int
+	}{
+		{name: "retried", script: "http:503", retries: 2, updates: 2},
+		{name: "retries exhausted", script: "http:503,http:503", retries: 2, status: 503, updates: 2},
+		{name: "not retryable", script: "http:500", retries: 2, status: 500, updates: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			s, emu := testSolr(t, func(c *ServiceConfig) {
+				c.HttpRetries = test.retries
+				c.HttpRetryBase = 1
+				c.HttpRetryMax = 1
+				c.HttpRetryStatus = []int{http.StatusServiceUnavailable}
+			})
+			_ = emu.Script(test.script)
+
+			bufferDocs(t, s, "a", "b")
+			_, err := s.ForceAdd()
+
+			var statusErr *HttpStatusError
+			switch {
+			case test.status == 0 && err != nil:
+				t.Fatalf("unexpected error: %s", err.Error())
+			case test.status != 0 && (errors.As(err, &statusErr) == false || statusErr.StatusCode != test.status):
+				t.Fatalf("expected HTTP %d, got %v", test.status, err)
+			}
+			if emu.Updates() != test.updates {
+				t.Errorf("expected %d update requests, got %d", test.updates, emu.Updates())
+			}
+
+			// a failed batch remains buffered and is sent again
+			if err != nil {
+				if _, err = s.ForceAdd(); err != nil || emu.DocCount() != 2 {
+					t.Errorf("expected the retained batch to be added, got %v and %d documents", err, emu.DocCount())
+				}
+			}
+		})
+	}
+}
+
+func TestSolrRetryStops(t *testing.T) {
+
+	s, emu := testSolr(t, func(c *ServiceConfig) {
+		c.HttpRetries = 3
+		c.HttpRetryBase = 60000
+		c.HttpRetryMax = 60000
+		c.HttpRetryStatus = []int{http.StatusServiceUnavailable}
+	})
+	_ = emu.Script("http:503")
+
+	// we are shutting down so we do not wait to retry
+	stop := make(chan struct{})
+	close(stop)
+	s.stop = stop
+
+	bufferDocs(t, s, "a")
+	start := time.Now()
+	if _, err := s.ForceAdd(); err == nil {
+		t.Fatalf("expected the add to fail")
+	}
+	if time.Since(start) > 10*time.Second || emu.Updates() != 1 {
+		t.Errorf("expected a single attempt, got %d in %s", emu.Updates(), time.Since(start))
+	}
+}
+
+func TestSolrLimitStops(t *testing.T) {
+
+	s, emu := testSolr(t, nil)
+
+	// another worker has the only request the destination allows and we are shutting down
+	s.limiter = testRequestLimiter(t, 1, 1, 1, 0)
+	stop := make(chan struct{})
+	close(stop)
+	s.stop = stop
+	_, _ = s.limiter.acquire(2, nil)
+
+	bufferDocs(t, s, "a")
+	if _, err := s.ForceAdd(); err != ErrShuttingDown {
+		t.Fatalf("expected %v, got %v", ErrShuttingDown, err)
+	}
+	if emu.Updates() != 0 || s.pendingAdds != 1 {
+		t.Errorf("expected no request and the document kept, got %d requests and %d documents", emu.Updates(), s.pendingAdds)
+	}
+	if s.breaker.failures != 0 {
+		t.Errorf("expected the breaker not to count a failure, got %d", s.breaker.failures)
+	}
+}
+
+func TestSolrSizerIgnoresRetryWait(t *testing.T) {
+
+	s, emu := testSolr(t, func(c *ServiceConfig) {
+		c.HttpRetries = 2
+		c.HttpRetryBase = 1000
+		c.HttpRetryMax = 1000
+		c.HttpRetryStatus = []int{http.StatusServiceUnavailable}
+		c.AdaptiveBatching = true
+		c.AdaptiveTargetLatency = 400
+		c.SolrBlockCount = 4
+		c.SolrMinBlockCount = 1
+	})
+	_ = emu.Script("http:503")
+
+	// the add takes longer than the target because we wait to retry, but SOLR itself was quick
+	bufferDocs(t, s, "a", "b", "c", "d")
+	if _, err := s.ForceAdd(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if s.sizer.blockCount() != 4 {
+		t.Errorf("expected the block count to stay at 4, got %d", s.sizer.blockCount())
+	}
+}
+
+func TestSolrGzipFallback(t *testing.T) {
+
+	s, emu := testSolr(t, func(c *ServiceConfig) {
+		c.SolrGzip = true
+	})
+	emu.RejectGzip()
+
+	// large enough to be compressed
+	padding := strings.Repeat("x", gzipMinSize)
+	_ = s.BufferDoc("a", "add", []byte(fmt.Sprintf(`<doc><field name="id">a</field><field name="text">%s</field></doc>`, padding)))
+
+	if _, err := s.ForceAdd(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if s.gzip == true {
+		t.Errorf("expected compression to be disabled")
+	}
+	if emu.DocCount() != 1 {
+		t.Errorf("expected 1 document indexed, got %d", emu.DocCount())
+	}
+}
+
+func TestSolrCommitFailure(t *testing.T) {
+
+	s, emu := testSolr(t, nil)
+	_ = emu.Script("commit:503")
+
+	bufferDocs(t, s, "a")
+	if _, err := s.ForceAdd(); err != nil {
+		t.Fatalf("a commit failure should not fail an add: %s", err.Error())
+	}
+
+	var statusErr *HttpStatusError
+	if err := s.ForceCommit(); errors.As(err, &statusErr) == false || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected HTTP 503, got %v", err)
+	}
+	if err := s.ForceCommit(); err != nil || emu.Commits() != 1 {
+		t.Errorf("expected the second commit to succeed, got %v and %d commits", err, emu.Commits())
+	}
+}
+
+//
+// end of file
+//
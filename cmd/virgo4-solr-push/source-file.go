@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// how many parsed documents we buffer ahead of the workers
+var fileSourceBacklog = 100
+
+// our filesystem/stdin message source. Each input contains one or more SOLR XML documents (either bare <doc>
+// elements or wrapped in <add>) or document ids wrapped in <delete>. Every document or id becomes a message, in
+// the order they appear, with the record id taken from the uniqueKey field and the matching record operation.
+type fileSource struct {
+	path      string              // the directory, glob, tar archive or - for stdin
+	uniqueKey string              // the uniqueKey field name
+	messages  chan awssqs.Message // the parsed documents
+}
+
+// Initialize our file message source
+func newFileSource(config *ServiceConfig) (MessageSource, error) {
+
+	source := &fileSource{path: config.SourcePath, uniqueKey: config.SolrUniqueKey}
+	source.messages = make(chan awssqs.Message, fileSourceBacklog)
+
+	// make sure we have something to read before we start
+	if source.path != "-" && source.isTar() == false {
+		files, err := source.files()
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files match [%s]", source.path)
+		}
+	}
+
+	go source.produce()
+	return source, nil
+}
+
+func (s *fileSource) Receive() ([]awssqs.Message, error) {
+
+	// wait for the first one
+	message, ok := <-s.messages
+	if ok == false {
+		return nil, io.EOF
+	}
+
+	// then take whatever else is available
+	messages := []awssqs.Message{message}
+	for uint(len(messages)) < awssqs.MAX_SQS_BLOCK_COUNT {
+		select {
+		case message, ok = <-s.messages:
+			if ok == false {
+				return messages, nil
+			}
+			messages = append(messages, message)
+		default:
+			return messages, nil
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *fileSource) Acknowledge(workerId int, messages []awssqs.Message) error {
+	// nothing to do
+	return nil
+}
+
+func (s *fileSource) Reject(workerId int, message awssqs.Message, rejection Rejection) error {
+	log.Printf("worker %d: ERROR document from %s rejected by %s, id/doc number %s (%s)", workerId, message.ReceiptHandle,
+		rejection.Destination, rejection.FailedDoc, rejection.Reason)
+	return nil
+}
+
+// read all the inputs and close the message channel when done
+func (s *fileSource) produce() {
+
+	defer close(s.messages)
+
+	if s.path == "-" {
+		s.parse("stdin", os.Stdin)
+		return
+	}
+
+	if s.isTar() == true {
+		err := s.produceTar()
+		if err != nil {
+			log.Printf("ERROR: reading %s (%s)", s.path, err.Error())
+		}
+		return
+	}
+
+	files, err := s.files()
+	if err != nil {
+		log.Printf("ERROR: reading %s (%s)", s.path, err.Error())
+		return
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Printf("ERROR: opening %s (%s), skipping", name, err.Error())
+			continue
+		}
+		s.parse(name, f)
+		f.Close()
+	}
+}
+
+// read the documents from each tar archive entry
+func (s *fileSource) produceTar() error {
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(s.path, ".gz") || strings.HasSuffix(s.path, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			s.parse(fmt.Sprintf("%s:%s", s.path, header.Name), archive)
+		}
+	}
+}
+
+// a document or a delete by id as read from the input, the raw content is kept so the payload is the
+// document exactly as it appears
+type fileRecord struct {
+	Fields []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"field"`
+	Value string `xml:",chardata"`
+	Inner []byte `xml:",innerxml"`
+}
+
+// parse the documents in the input and queue a message for each one. The input is streamed so only a single
+// document is held in memory at a time
+func (s *fileSource) parse(name string, reader io.Reader) {
+
+	decoder := xml.NewDecoder(reader)
+	count := 0
+
+	// the enclosing elements of the current one
+	parents := make([]string, 0)
+
+parsing:
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("ERROR: parsing %s (%s), skipping the remainder", name, err.Error())
+			break
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+
+			// documents (excluding any sub-documents) and deletes by id, in the order they appear
+			inDelete := len(parents) != 0 && parents[len(parents)-1] == "delete"
+			if element.Name.Local != "doc" && (element.Name.Local != "id" || inDelete == false) {
+				parents = append(parents, element.Name.Local)
+				continue
+			}
+
+			var record fileRecord
+			err = decoder.DecodeElement(&record, &element)
+			if err != nil {
+				log.Printf("ERROR: parsing %s (%s), skipping the remainder", name, err.Error())
+				break parsing
+			}
+
+			count++
+			payload := outerXml(element, record.Inner)
+			if element.Name.Local == "id" {
+				s.messages <- s.makeMessage(name, count, strings.TrimSpace(record.Value), awssqs.AttributeValueRecordOperationDelete, payload)
+				continue
+			}
+
+			id := ""
+			for _, f := range record.Fields {
+				if f.Name == s.uniqueKey {
+					id = strings.TrimSpace(f.Value)
+					break
+				}
+			}
+			s.messages <- s.makeMessage(name, count, id, awssqs.AttributeValueRecordOperationUpdate, payload)
+
+		case xml.EndElement:
+			if len(parents) != 0 {
+				parents = parents[:len(parents)-1]
+			}
+		}
+	}
+
+	log.Printf("INFO: read %d documents from %s", count, name)
+}
+
+// rebuild an element from its start tag and raw content
+func outerXml(element xml.StartElement, inner []byte) string {
+
+	var buf strings.Builder
+	buf.WriteString("<" + element.Name.Local)
+	for _, attr := range element.Attr {
+		switch attr.Name.Space {
+		case "":
+			buf.WriteString(" " + attr.Name.Local + `="`)
+		case "xmlns":
+			buf.WriteString(" xmlns:" + attr.Name.Local + `="`)
+		default:
+			log.Printf("WARNING: dropping namespaced attribute %s from <%s>", attr.Name.Local, element.Name.Local)
+			continue
+		}
+		_ = xml.EscapeText(&buf, []byte(attr.Value))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+	buf.Write(inner)
+	buf.WriteString("</" + element.Name.Local + ">")
+	return buf.String()
+}
+
+func (s *fileSource) makeMessage(name string, index int, id string, operation string, payload string) awssqs.Message {
+
+	message := awssqs.Message{Payload: []byte(payload)}
+	message.ReceiptHandle = awssqs.ReceiptHandle(fmt.Sprintf("%s#%d", name, index))
+	message.Attribs = awssqs.Attributes{{Name: awssqs.AttributeKeyRecordOperation, Value: operation}}
+	if len(id) != 0 {
+		message.Attribs = append(message.Attribs, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
+	}
+	return message
+}
+
+// the list of files to read, either the contents of a directory or the files matching a glob
+func (s *fileSource) files() ([]string, error) {
+
+	info, err := os.Stat(s.path)
+	if err == nil && info.IsDir() == true {
+		entries, err := os.ReadDir(s.path)
+		if err != nil {
+			return nil, err
+		}
+		files := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if e.Type().IsRegular() == true {
+				files = append(files, filepath.Join(s.path, e.Name()))
+			}
+		}
+		return files, nil
+	}
+
+	files, err := filepath.Glob(s.path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *fileSource) isTar() bool {
+	return strings.HasSuffix(s.path, ".tar") || strings.HasSuffix(s.path, ".tar.gz") || strings.HasSuffix(s.path, ".tgz")
+}
+
+//
+// end of file
+//
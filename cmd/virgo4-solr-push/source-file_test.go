@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestFileSourceParse(t *testing.T) {
+
+	input := `<update>
+  <add><doc><field name="id">a</field><doc><field name="id">a-1</field></doc></doc></add>
+  <delete><id>b</id></delete>
+  <add><doc><field name="id">c</field></doc></add>
+</update>`
+
+	s := &fileSource{uniqueKey: defaultUniqueKey, messages: make(chan awssqs.Message, 10)}
+	s.parse("test", strings.NewReader(input))
+	close(s.messages)
+
+	got := make([]string, 0)
+	for m := range s.messages {
+		id, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
+		operation, _ := m.GetAttribute(awssqs.AttributeKeyRecordOperation)
+		got = append(got, operation+":"+id)
+	}
+
+	expected := []string{"update:a", "delete:b", "update:c"}
+	if reflect.DeepEqual(got, expected) == false {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestFileSourcePayloads(t *testing.T) {
+
+	input := `<add>
+  <doc boost="2.5"><field name="id">a</field><field name="title">x &amp; y</field><doc><field name="id">a-1</field></doc></doc>
+  <doc><field name="id">b</field></doc>
+  <doc><field name="id">c</field>
+</add>`
+
+	s := &fileSource{uniqueKey: defaultUniqueKey, messages: make(chan awssqs.Message, 10)}
+	s.parse("test", strings.NewReader(input))
+	close(s.messages)
+
+	// the documents are sent as they appear and a malformed one ends the input
+	expected := []string{
+		`<doc boost="2.5"><field name="id">a</field><field name="title">x &amp; y</field><doc><field name="id">a-1</field></doc></doc>`,
+		`<doc><field name="id">b</field></doc>`,
+	}
+	got := make([]string, 0)
+	for m := range s.messages {
+		got = append(got, string(m.Payload))
+	}
+	if reflect.DeepEqual(got, expected) == false {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+//
+// end of file
+//
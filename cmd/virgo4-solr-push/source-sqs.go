@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// our SQS message source
+type sqsSource struct {
+	aws         awssqs.AWS_SQS     // the AWS SQS helper object
+	inQueue     awssqs.QueueHandle // the inbound queue
+	failQueue   awssqs.QueueHandle // the failure queue (optional)
+	pollTimeout time.Duration      // the inbound queue poll timeout
+}
+
+// Initialize our SQS message source
+func newSqsSource(config *ServiceConfig) (MessageSource, error) {
+
+	// load our AWS_SQS helper object
+	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: config.MessageBucketName})
+	if err != nil {
+		return nil, err
+	}
+
+	source := &sqsSource{aws: aws, pollTimeout: time.Duration(config.PollTimeOut) * time.Second}
+
+	// get the queue handle from the queue name
+	source.inQueue, err = aws.QueueHandle(config.InQueueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the failure queue handle if we are configured to use one
+	if len(config.FailureQueueName) != 0 {
+		source.failQueue, err = aws.QueueHandle(config.FailureQueueName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+func (s *sqsSource) Receive() ([]awssqs.Message, error) {
+	return s.aws.BatchMessageGet(s.inQueue, awssqs.MAX_SQS_BLOCK_COUNT, s.pollTimeout)
+}
+
+func (s *sqsSource) Acknowledge(workerId int, messages []awssqs.Message) error {
+	return batchDelete(workerId, s.aws, s.inQueue, messages)
+}
+
+func (s *sqsSource) Reject(workerId int, message awssqs.Message, rejection Rejection) error {
+	return rejectMessage(workerId, s.aws, s.inQueue, s.failQueue, message, rejection)
+}
+
+func batchDelete(workerId int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []awssqs.Message) error {
+
+	// ensure there is work to do
+	count := uint(len(messages))
+	if count == 0 {
+		return nil
+	}
+
+	//log.Printf( "worker %d: About to delete block of %d", workerId, count )
+
+	start := time.Now()
+
+	// we do delete in blocks of awssqs.MAX_SQS_BLOCK_COUNT
+	fullBlocks := count / awssqs.MAX_SQS_BLOCK_COUNT
+	remainder := count % awssqs.MAX_SQS_BLOCK_COUNT
+
+	// go through the inbound messages a 'block' at a time
+	for bix := uint(0); bix < fullBlocks; bix++ {
+
+		// calculate slice range
+		start := bix * awssqs.MAX_SQS_BLOCK_COUNT
+		end := start + awssqs.MAX_SQS_BLOCK_COUNT
+
+		//log.Printf( "worker %d: Deleting slice [%d:%d]", workerId, start, end )
+
+		// and delete them
+		err := blockDelete(workerId, aws, queue, messages[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	// handle any remaining
+	if remainder != 0 {
+
+		// calculate slice range
+		start := fullBlocks * awssqs.MAX_SQS_BLOCK_COUNT
+		end := start + remainder
+
+		//log.Printf( "worker %d: Deleting slice [%d:%d]", workerId, start, end )
+
+		// and delete them
+		err := blockDelete(workerId, aws, queue, messages[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	duration := time.Since(start)
+	log.Printf("worker %d: batch delete completed in %0.2f seconds", workerId, duration.Seconds())
+
+	return nil
+}
+
+func blockDelete(workerId int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []awssqs.Message) error {
+
+	// delete the block
+	opStatus, err := aws.BatchMessageDelete(queue, messages)
+	if err != nil {
+		if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			sqsDeletes.WithLabelValues("failed").Add(float64(len(messages)))
+			return err
+		}
+	}
+
+	// did we fail
+	failed := 0
+	if err == awssqs.ErrOneOrMoreOperationsUnsuccessful {
+		for ix, op := range opStatus {
+			if op == false {
+				log.Printf("worker %d: ERROR message %d failed to delete", workerId, ix)
+				failed++
+			}
+		}
+	}
+
+	sqsDeletes.WithLabelValues("succeeded").Add(float64(len(messages) - failed))
+	sqsDeletes.WithLabelValues("failed").Add(float64(failed))
+
+	return nil
+}
+
+//
+// end of file
+//
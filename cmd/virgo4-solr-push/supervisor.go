@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// run a worker function, restarting it if it panics. Returns when the function returns normally or when we
+// are told to stop. Exceeding the configured number of restarts is fatal
+func supervise(workerId int, name string, config *ServiceConfig, stop <-chan struct{}, run func()) {
+
+	restarts := 0
+	for {
+
+		if runRecovered(workerId, name, run) == true {
+			return
+		}
+
+		restarts++
+		if config.MaxWorkerRestarts != 0 && restarts > config.MaxWorkerRestarts {
+			log.Fatalf("FATAL ERROR: worker %d: %s restarted too many times (%d), giving up", workerId, name, config.MaxWorkerRestarts)
+		}
+
+		log.Printf("worker %d: WARNING restarting %s (restart %d)", workerId, name, restarts)
+
+		// wait a while before restarting unless we are shutting down
+		select {
+		case <-stop:
+			return
+		case <-time.After(waitTimeout):
+		}
+	}
+}
+
+// run the function and recover from any panic, returns true if the function returned normally
+func runRecovered(workerId int, name string, run func()) (clean bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("worker %d: ERROR %s panic (%v)\n%s", workerId, name, r, debug.Stack())
+			clean = false
+		}
+	}()
+
+	run()
+	return true
+}
+
+//
+// end of file
+//
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the uniqueKey field name we use if we cannot discover it
+var defaultUniqueKey = "id"
+
+var errNoUniqueKey = fmt.Errorf("no uniqueKey in response")
+
+// ask the primary SOLR core for its uniqueKey field name. SOLR may not be available yet so we keep trying until
+// it answers, using the default if it cannot tell us or we have failed too many times
+func discoverUniqueKey(config *ServiceConfig) string {
+
+	url := fmt.Sprintf("%s/%s/schema/uniquekey?wt=json", config.SolrUrl, config.SolrCoreName)
+	client := &http.Client{Timeout: time.Duration(config.SolrTimeout) * time.Second}
+	retry := newBackoff(time.Duration(config.RetryBackoff)*time.Second, time.Duration(config.RetryBackoffMax)*time.Second)
+
+	for {
+		uniqueKey, err := getUniqueKey(client, url)
+		if err == nil {
+			log.Printf("INFO: discovered SOLR uniqueKey [%s]", uniqueKey)
+			return uniqueKey
+		}
+
+		// SOLR answered but cannot tell us, or we have tried too many times
+		delay := retry.failed()
+		if uniqueKeyUnavailable(err) == true || (config.MaxConsecutiveFailures != 0 && retry.failures >= config.MaxConsecutiveFailures) {
+			log.Printf("WARNING: ******************************************************************************")
+			log.Printf("WARNING: cannot discover the SOLR uniqueKey (%s)", err.Error())
+			log.Printf("WARNING: using [%s], set VIRGO4_SOLR_PUSH_SOLR_UNIQUE_KEY if this is not correct", defaultUniqueKey)
+			log.Printf("WARNING: ******************************************************************************")
+			return defaultUniqueKey
+		}
+
+		log.Printf("WARNING: SOLR is not available to discover the uniqueKey, retrying in %s (%s)", delay, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// did SOLR answer without telling us the uniqueKey, rather than not answering at all
+func uniqueKeyUnavailable(err error) bool {
+
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) == true {
+		return statusErr.StatusCode < http.StatusInternalServerError && statusErr.StatusCode != http.StatusTooManyRequests
+	}
+
+	return errors.Is(err, errNoUniqueKey) == true
+}
+
+func getUniqueKey(client *http.Client, url string) (string, error) {
+
+	response, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", &HttpStatusError{StatusCode: response.StatusCode}
+	}
+
+	var payload struct {
+		UniqueKey string `json:"uniqueKey"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&payload)
+	if err != nil {
+		return "", fmt.Errorf("%w (%s)", errNoUniqueKey, err.Error())
+	}
+
+	if len(payload.UniqueKey) == 0 {
+		return "", errNoUniqueKey
+	}
+	return payload.UniqueKey, nil
+}
+
+// make sure the message has an id attribute, using the id from the payload if it does not. If we are configured
+// to do so, flag messages where the attribute and the payload disagree
+func identifyMessage(workerId int, config *ServiceConfig, message awssqs.Message) awssqs.Message {
+
+	id, found := message.GetAttribute(awssqs.AttributeKeyRecordId)
+	if found == true && config.VerifyIds == false {
+		return message
+	}
+
+	docId, ok := payloadId(config, messageMode(config, message), message.Payload)
+	if ok == false {
+		return message
+	}
+
+	if found == false {
+		log.Printf("worker %d: INFO message has no id attribute, using payload id %s", workerId, docId)
+		attribs := make(awssqs.Attributes, 0, len(message.Attribs)+1)
+		attribs = append(attribs, message.Attribs...)
+		message.Attribs = append(attribs, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: docId})
+		return message
+	}
+
+	if id != docId {
+		log.Printf("worker %d: WARNING message id %s does not match payload id %s", workerId, id, docId)
+		idMismatches.Inc()
+	}
+	return message
+}
+
+// get the document id from the payload for the specified operation. For adds this is the uniqueKey field
+// of the top level document, for deletes it is the (first) id
+func payloadId(config *ServiceConfig, mode string, payload []byte) (string, bool) {
+
+	if config.SolrFormat == "json" {
+		return jsonPayloadId(config.SolrUniqueKey, mode, payload)
+	}
+	return xmlPayloadId(config.SolrUniqueKey, mode, payload)
+}
+
+// we only read as far as the id which is usually near the start of the document
+func xmlPayloadId(uniqueKey string, mode string, payload []byte) (string, bool) {
+
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	docDepth := -1
+	depth := 0
+	var id *strings.Builder
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+
+		switch t := token.(type) {
+
+		case xml.StartElement:
+			depth++
+			switch {
+			case mode == "delete" && t.Name.Local == "id":
+				id = &strings.Builder{}
+			case docDepth == -1 && t.Name.Local == "doc":
+				docDepth = depth
+			case depth == docDepth+1 && t.Name.Local == "field":
+				for _, a := range t.Attr {
+					if a.Name.Local == "name" && a.Value == uniqueKey {
+						id = &strings.Builder{}
+					}
+				}
+			}
+
+		case xml.CharData:
+			if id != nil {
+				id.Write(t)
+			}
+
+		case xml.EndElement:
+			depth--
+			if id != nil {
+				value := strings.TrimSpace(id.String())
+				return value, len(value) != 0
+			}
+			if depth < docDepth {
+				// the end of the document and no id
+				return "", false
+			}
+		}
+	}
+}
+
+func jsonPayloadId(uniqueKey string, mode string, payload []byte) (string, bool) {
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return "", false
+	}
+
+	// a bare id to delete
+	if mode == "delete" && payload[0] != '{' {
+		id := string(payload)
+		if unquoted, err := strconv.Unquote(id); err == nil {
+			id = unquoted
+		}
+		return id, true
+	}
+
+	// deletes use id, documents use the uniqueKey field
+	key := uniqueKey
+	if mode == "delete" {
+		key = "id"
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil && err != io.EOF {
+		return "", false
+	}
+
+	value, found := document[key]
+	if found == false {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, len(v) != 0
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+//
+// end of file
+//
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestDiscoverUniqueKey(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		responses []int // the status of each response, the last one repeats
+		body      string
+		uniqueKey string
+		requests  int
+	}{
+		{name: "discovered", responses: []int{http.StatusOK}, body: `{"uniqueKey":"key"}`, uniqueKey: "key", requests: 1},
+		{name: "retried until available", responses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			body: `{"uniqueKey":"key"}`, uniqueKey: "key", requests: 3},
+		{name: "not supported", responses: []int{http.StatusNotFound}, uniqueKey: defaultUniqueKey, requests: 1},
+		{name: "not understood", responses: []int{http.StatusOK}, body: `<html/>`, uniqueKey: defaultUniqueKey, requests: 1},
+		{name: "too many failures", responses: []int{http.StatusServiceUnavailable}, uniqueKey: defaultUniqueKey, requests: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var lock sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				status := test.responses[min(requests, len(test.responses)-1)]
+				requests++
+				lock.Unlock()
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			config := testConfig()
+			config.SolrUrl = server.URL
+			config.MaxConsecutiveFailures = 4
+
+			if got := discoverUniqueKey(&config); got != test.uniqueKey {
+				t.Errorf("expected uniqueKey [%s], got [%s]", test.uniqueKey, got)
+			}
+			if requests != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, requests)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
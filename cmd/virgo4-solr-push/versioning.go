@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// optimistic concurrency. When configured, the document version is written into the version field of each
+// document we add so SOLR can reject writes that are older than the document it already has. A doc-based
+// versioning update processor (DocBasedVersionConstraintsProcessorFactory) does the checking, SOLR's own
+// _version_ field cannot be used as it demands an exact match. A version conflict means a newer copy of the
+// document is already indexed so the message is done with, but only once we know which document it was
+//
+
+var ErrVersionConflict = fmt.Errorf("document version conflict")
+
+// the message doc-based versioning reports for a version conflict, it does not identify the document
+var versionConflictRe = regexp.MustCompile(`user version is not high enough`)
+
+// get the version of a message, either from the version attribute or the time it was sent
+func messageVersion(config *ServiceConfig, message awssqs.Message) (string, bool) {
+
+	if len(config.VersionAttribute) != 0 {
+		version, found := message.GetAttribute(config.VersionAttribute)
+		if found == true {
+			return version, true
+		}
+	}
+
+	if message.FirstSent != 0 {
+		return strconv.FormatUint(message.FirstSent, 10), true
+	}
+
+	return "", false
+}
+
+// get the message payload with the version field added. If we cannot, the document is sent unversioned
+func versionedPayload(config *ServiceConfig, id string, message awssqs.Message) []byte {
+
+	version, found := messageVersion(config, message)
+	if found == false {
+		log.Printf("WARNING: cannot determine the version of id %s, sending it unversioned", id)
+		return message.Payload
+	}
+
+	var payload []byte
+	var err error
+	if config.SolrFormat == "json" {
+		payload, err = jsonWithField(message.Payload, config.VersionField, version)
+	} else {
+		payload, err = xmlWithField(message.Payload, config.VersionField, version)
+	}
+
+	if err != nil {
+		log.Printf("WARNING: cannot version id %s, sending it unversioned (%s)", id, err.Error())
+		return message.Payload
+	}
+	return payload
+}
+
+// set a field of an XML document, replacing any existing values. Sub-documents keep their own values
+func xmlWithField(doc []byte, name string, value string) ([]byte, error) {
+
+	parsed, err := parseXmlDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed.Remove(name)
+	parsed.Add(name, value)
+	return parsed.Encode(), nil
+}
+
+// set a field of a JSON document, replacing any existing values. Numeric versions are written as numbers
+func jsonWithField(doc []byte, name string, value string) ([]byte, error) {
+
+	parsed, err := parseJsonDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedValue, _ := json.Marshal(value)
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		encodedValue = []byte(value)
+	}
+
+	parsed.Remove(name)
+	delete(parsed.arrays, name)
+	parsed.Fields = append(parsed.Fields, DocumentField{Name: name, Value: value, raw: encodedValue})
+	return parsed.Encode(), nil
+}
+
+// does the error message report a version conflict
+func isVersionConflict(message string) bool {
+	return versionConflictRe.MatchString(message)
+}
+
+//
+// end of file
+//
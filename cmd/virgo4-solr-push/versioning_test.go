@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestXmlWithField(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		doc      string
+		expected string
+	}{
+		{name: "added",
+			doc:      `<doc><field name="id">a</field></doc>`,
+			expected: `<doc><field name="id">a</field><field name="version_l">42</field></doc>`},
+		{name: "existing value replaced",
+			doc:      `<doc><field name="version_l">1</field><field name="id">a</field><field name="version_l">2</field></doc>`,
+			expected: `<doc><field name="id">a</field><field name="version_l">42</field></doc>`},
+		{name: "sub-document keeps its own",
+			doc:      `<doc><field name="id">a</field><doc><field name="version_l">1</field></doc></doc>`,
+			expected: `<doc><field name="id">a</field><doc><field name="version_l">1</field></doc><field name="version_l">42</field></doc>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := xmlWithField([]byte(test.doc), "version_l", "42")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(got) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := xmlWithField([]byte(`<add>`), "version_l", "42"); err == nil {
+		t.Errorf("expected an error for a payload without a document")
+	}
+}
+
+func TestJsonWithField(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		doc      string
+		value    string
+		expected string
+	}{
+		{name: "numeric", doc: `{"id":"a"}`, value: "42", expected: `{"id":"a","version_l":42}`},
+		{name: "text", doc: `{"id":"a"}`, value: "v2", expected: `{"id":"a","version_l":"v2"}`},
+		{name: "empty document", doc: `{}`, value: "42", expected: `{"version_l":42}`},
+		{name: "existing value replaced", doc: `{"version_l":1,"id":"a"}`, value: "42", expected: `{"id":"a","version_l":42}`},
+		{name: "existing array replaced", doc: `{"id":"a","version_l":[1,2]}`, value: "42", expected: `{"id":"a","version_l":42}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := jsonWithField([]byte(test.doc), "version_l", test.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(got) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := jsonWithField([]byte(`["a"]`), "version_l", "42"); err == nil {
+		t.Errorf("expected an error for a payload that is not a document")
+	}
+}
+
+func TestVersionedPayload(t *testing.T) {
+
+	config := testConfig()
+	config.VersionField = "version_l"
+	config.VersionAttribute = "version"
+
+	m := testMessage("a")
+	m.FirstSent = 7
+	if got := string(versionedPayload(&config, "a", m)); got != `<doc><field name="id">a</field><field name="version_l">7</field></doc>` {
+		t.Errorf("expected the sent time as the version, got %s", got)
+	}
+
+	m.Attribs = append(m.Attribs, awssqs.Attribute{Name: "version", Value: "9"})
+	if got := string(versionedPayload(&config, "a", m)); got != `<doc><field name="id">a</field><field name="version_l">9</field></doc>` {
+		t.Errorf("expected the version attribute as the version, got %s", got)
+	}
+}
+
+func TestVersionConflictSettled(t *testing.T) {
+
+	s, emu := testSolr(t, nil)
+	d, _ := testDestination(t, "")
+	d.solr = s
+	stale := func() float64 { return testutil.ToFloat64(documentsStale.WithLabelValues(d.name)) }
+	before := stale()
+
+	// SOLR does not say which document is stale so the batch is bisected
+	_ = emu.Script("conflict:x,ok,conflict:x")
+	source := &testSource{}
+	tracker := newMessageTracker(1, source)
+	for _, id := range []string{"a", "b"} {
+		_ = d.buffer(trackedTestMessage(tracker, id, 1))
+	}
+
+	result, err := d.flush()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err = tracker.update(result); err != nil {
+		t.Fatalf("update failed: %s", err.Error())
+	}
+	tracker.close()
+
+	// the stale document is done with, it is not a failure
+	if reflect.DeepEqual(source.acknowledged, []string{"a", "b"}) == false || len(source.rejected) != 0 {
+		t.Errorf("expected a and b to be acknowledged and nothing rejected, got %v and %v", source.acknowledged, source.rejected)
+	}
+	if stale()-before != 1 {
+		t.Errorf("expected 1 stale document, got %0.0f", stale()-before)
+	}
+	if emu.DocCount() != 1 {
+		t.Errorf("expected only a to be indexed, got %d documents", emu.DocCount())
+	}
+}
+
+//
+// end of file
+//
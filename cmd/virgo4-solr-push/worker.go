@@ -1,281 +1,469 @@
 package main
 
 import (
+	"fmt"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 // time to wait for inbound messages before doing something else
 var waitTimeout = 5 * time.Second
 
-func worker(workerId int, config *ServiceConfig, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, inbound <-chan awssqs.Message) {
+// how often we check to see if SOLR is available again
+var breakerCheckTime = 1 * time.Second
 
-	// create our SOLR instance
-	solr, err := NewSolr(workerId, *config)
-	fatalIfError(err)
+// how often we check to see if the buffered documents are back within the memory budget
+var budgetCheckTime = 100 * time.Millisecond
 
-	// keep a list of the messages queued so we can delete them once they are sent to SOLR
-	queued := make([]awssqs.Message, 0, config.SolrBlockCount)
+// run a worker, restarting it if it panics. Any messages it had buffered are redelivered by the source
+func superviseWorker(workerId int, config *ServiceConfig, source MessageSource, inbound <-chan awssqs.Message, stop <-chan struct{}, done *sync.WaitGroup) {
+
+	defer done.Done()
+	supervise(workerId, "worker", config, stop, func() {
+		worker(workerId, config, source, inbound, stop)
+	})
+}
+
+func worker(workerId int, config *ServiceConfig, source MessageSource, inbound <-chan awssqs.Message, stop <-chan struct{}) {
+
+	// create our destinations, the required ones are handled here and each optional one is handled by a
+	// separate goroutine so it can lag or fail without blocking the others. The batches added to the required
+	// ones in the background report back to us when they are done
+	required := make([]*pipeline, 0, len(config.Destinations))
+	optional := make([]chan awssqs.Message, 0)
+	flights := make(chan flight, len(config.Destinations)*config.InFlightBatches)
+	var optionalDone sync.WaitGroup
+
+	// if we return early or panic, the optional workers finish whatever they have
+	defer func() {
+		for _, queue := range optional {
+			close(queue)
+		}
+	}()
+
+	// and once the batches in flight are done, we give up on whatever the required destinations still have
+	// buffered so it no longer counts against the memory budget
+	defer func() {
+		for inFlight(required) != 0 {
+			f := <-flights
+			f.pipe.inFlight--
+		}
+		for _, dest := range required {
+			dest.abandon()
+		}
+	}()
+
+	for _, dc := range config.Destinations {
+
+		if dc.Required == true {
+			dest := connectPipeline(workerId, config, dc, flights, stop)
+			if dest == nil {
+				// we were told to stop before we connected
+				return
+			}
+			required = append(required, dest)
+		} else {
+			queue := make(chan awssqs.Message, config.WorkerQueueSize)
+			optional = append(optional, queue)
+			optionalDone.Add(1)
+			go superviseOptionalWorker(workerId, config, dc, queue, stop, &optionalDone)
+		}
+	}
+
+	// track the messages so we can delete them once all the required destinations are done with them
+	tracker := newMessageTracker(workerId, source)
+	defer func() {
+		if tracker != nil {
+			tracker.close()
+		}
+	}()
 	var message awssqs.Message
 
 	for {
 
 		arrived := false
 
+		// if one of the required destinations is failing we stop taking new messages until it is time to retry
+		// or until SOLR is available again. We also stop if the next batch is waiting for one in flight or the
+		// workers have buffered more than the memory budget
+		wait := waitTimeout
+		messages := inbound
+		if bufferBudget.exceeded() == true {
+			messages = nil
+			if budgetCheckTime < wait {
+				wait = budgetCheckTime
+			}
+		}
+		for _, dest := range required {
+			if dest.stalled == true {
+				messages = nil
+			} else {
+				wait = dest.active.flushWait(wait)
+			}
+			if dest.breaker.isOpen() == true {
+				messages = nil
+				if breakerCheckTime < wait {
+					wait = breakerCheckTime
+				}
+			}
+			if dest.backoff.waiting() == true {
+				messages = nil
+				if dest.backoff.remaining() < wait {
+					wait = dest.backoff.remaining()
+				}
+			}
+		}
+
 		// process a message or wait...
 		select {
-		case message = <-inbound:
+		case message = <-messages:
 			arrived = true
 
-		case <-time.After(waitTimeout):
-		}
+		case f := <-flights:
+			f.pipe.land(f, tracker)
 
-		// we have an inbound message to process
-		if arrived == true {
+		case <-stop:
+			log.Printf("worker %d: INFO shutting down, draining inbound messages", workerId)
+
+			// process anything still waiting for us
+			for drained := false; drained == false; {
+				select {
+				case message = <-inbound:
+					processMessage(workerId, config, message, required, optional, tracker)
+					flushIfTime(required, tracker)
+				case f := <-flights:
+					f.pipe.land(f, tracker)
+				default:
+					drained = true
+				}
+			}
 
-			// get the message identifier
-			id, found := message.GetAttribute(awssqs.AttributeKeyRecordId)
-			if found == false {
-				id = "unknown"
-				log.Printf("WARNING: cannot locate document id, using default")
+			// wait for the batches in flight, then add and commit whatever remains. The optional destinations
+			// do the same once their queues are empty
+			for inFlight(required) != 0 {
+				f := <-flights
+				f.pipe.land(f, tracker)
+			}
+			for _, dest := range required {
+				dest.flushAndCommit(tracker)
 			}
+			for _, queue := range optional {
+				close(queue)
+			}
+			optional = optional[:0]
+			optionalDone.Wait()
+
+			// and wait for the acknowledgements
+			tracker.close()
+			tracker = nil
 
-			// buffer it to SOLR
-			err = solr.BufferDoc(id, message.Payload)
-			fatalIfError(err)
+			log.Printf("worker %d: INFO shutdown complete", workerId)
+			return
 
-			// add it to the queued list
-			queued = append(queued, message)
+		case <-time.After(wait):
 		}
 
-		// check to see if it is time to 'add' these to SOLR
-		if solr.IsTimeToAdd() == true {
+		// we have an inbound message to process
+		if arrived == true {
+			processMessage(workerId, config, message, required, optional, tracker)
+		}
 
-			// we loop here because we try to rebuffer and reprocess any documents that were not processed...
+		flushIfTime(required, tracker)
 
-			for {
+		// we are still alive
+		serviceHealth.progress(workerId)
+	}
+}
 
-				// add them
-				var failedDoc string
-				failedDoc, err = solr.ForceAdd()
+// buffer a message to each of the required destinations and hand it to the optional ones
+func processMessage(workerId int, config *ServiceConfig, message awssqs.Message, required []*pipeline, optional []chan awssqs.Message, tracker *messageTracker) {
 
-				switch err {
+	// we need the document id to match SOLR failures to messages
+	message = identifyMessage(workerId, config, message)
 
-				// no error, everything OK
-				case nil:
-					// delete all of them
-					err = batchDelete(workerId, aws, queue, queued)
-					fatalIfError(err)
+	// make sure the payload will not spoil the batch, if it would then it is rejected now
+	if config.ValidatePayloads == true {
+		id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+		payload, err := normalizePayload(config, id, messageMode(config, message), message.Payload)
+		if err != nil {
+			log.Printf("worker %d: ERROR id %s has an invalid payload (%s)", workerId, id, err.Error())
+			rejectUnsent(workerId, message, preflightDestination, rejectReasonInvalidPayload, err, tracker)
+			return
+		}
+		message.Payload = payload
+	}
 
-					// clear the queue
-					queued = queued[:0]
+	// enrich and transform the document
+	payload, err := processDocument(config, message)
+	if err != nil {
+		id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+		log.Printf("worker %d: ERROR id %s cannot be processed (%s)", workerId, id, err.Error())
+		rejectUnsent(workerId, message, processorDestination, rejectReasonProcessor, err, tracker)
+		return
+	}
+	message.Payload = payload
 
-				// one of the documents failed
-				case ErrDocumentAdd:
+	tracker.track(message, len(required))
 
-					// convert the failed document number to a document index
-					failedIx, _ := strconv.Atoi(failedDoc)
-					failedIx--
+	// buffer it to each of the required destinations, if we cannot then the message is abandoned
+	for _, dest := range required {
+		err := dest.buffer(message)
+		if err != nil {
+			log.Printf("worker %d: ERROR %s buffer failed (%s)", workerId, dest.name, err.Error())
+			err = tracker.update(flushResult{abandoned: []awssqs.Message{message}})
+			if err != nil {
+				log.Printf("worker %d: ERROR %s update failed (%s)", workerId, dest.name, err.Error())
+			}
+		}
+	}
 
-					// how many do we have total
-					sz := len(queued)
+	// and hand it to the optional ones, dropping it if they are too far behind
+	for ix, queue := range optional {
+		select {
+		case queue <- message:
+		default:
+			name := optionalName(config, ix)
+			log.Printf("worker %d: WARNING optional destination %s is lagging, dropping message", workerId, name)
+			documentsDropped.WithLabelValues(name).Inc()
+		}
+	}
+}
 
-					// if the failure document was the first one
-					if failedIx == 0 {
+// the name of an optional destination from its position among the optional destinations
+func optionalName(config *ServiceConfig, ix int) string {
 
-						log.Printf("worker %d: WARNING first document in batch of %d failed, ignoring it and requing the remainder", workerId, sz)
+	for _, dc := range config.Destinations {
+		if dc.Required == false {
+			if ix == 0 {
+				return dc.Name
+			}
+			ix--
+		}
+	}
+	return "unknown"
+}
 
-						// ignore the one that failed and keep the remainder
-						queued = queued[1:]
+// add and commit for each of the required destinations if it is time to do so. The adds are made in the
+// background unless no batches may be in flight, failures leave the documents buffered and the destination
+// waits a while before trying again
+func flushIfTime(required []*pipeline, tracker *messageTracker) {
 
-						// if the failure document was not the last one
-					} else if failedIx < sz {
+	for _, dest := range required {
+		dest.sendIfTime(tracker)
+	}
+}
 
-						log.Printf("worker %d: WARNING purging documents 0 - %d, ignoring document %d, requeuing %d - %d",
-							workerId, failedIx-1, failedIx, failedIx+1, sz)
+// the number of batches being added to the required destinations
+func inFlight(required []*pipeline) int {
 
-						// delete the ones that succeeded
-						err = batchDelete(workerId, aws, queue, queued[0:failedIx])
-						fatalIfError(err)
+	count := 0
+	for _, dest := range required {
+		count += dest.inFlight
+	}
+	return count
+}
 
-						// ignore the one that failed and keep the remainder
-						queued = queued[failedIx+1:]
+// add any remaining documents for a required destination and commit, used during shutdown. We keep trying
+// until we succeed or the shutdown deadline is reached, anything not deleted is redelivered later
+func flushAndCommit(dest *destination, tracker *messageTracker) {
 
-						// the failure document was the last one
-					} else {
-						log.Printf("worker %d: WARNING last document in batch of %d failed, ignoring it", workerId, sz)
+	for len(dest.queued) != 0 {
+		result, err := dest.flush()
+		uerr := tracker.update(result)
+		if uerr != nil {
+			log.Printf("worker %d: ERROR %s final update failed, messages will be redelivered (%s)", dest.workerId, dest.name, uerr.Error())
+		}
+		if err == nil {
+			break
+		}
+		dest.failed("final add", err)
+		serviceHealth.waiting(dest.workerId, "flushing", dest.backoff.remaining())
+		time.Sleep(dest.backoff.remaining())
+	}
 
-						// delete all but the last of them of them
-						err = batchDelete(workerId, aws, queue, queued[0:sz])
-						fatalIfError(err)
+	for {
+		err := dest.solr.ForceCommit()
+		if err == nil {
+			break
+		}
+		dest.failed("final commit", err)
+		serviceHealth.waiting(dest.workerId, "flushing", dest.backoff.remaining())
+		time.Sleep(dest.backoff.remaining())
+	}
+}
 
-						// clear the queue
-						queued = queued[:0]
-					}
+// run an optional destination worker, restarting it if it panics
+func superviseOptionalWorker(workerId int, config *ServiceConfig, dc DestinationConfig, inbound <-chan awssqs.Message, stop <-chan struct{}, done *sync.WaitGroup) {
 
-				// all of the adds failed, attempt to handle as best we can...
-				case ErrAllDocumentAdd:
+	defer done.Done()
+	supervise(workerId, fmt.Sprintf("optional destination %s", dc.Name), config, stop, func() {
+		dest := connectDestination(workerId, config, dc, stop)
+		if dest != nil {
+			optionalWorker(dest, inbound, stop)
+		}
+	})
+}
 
-					// if we were able to identify the document that failed then we might be able to handle
-					// things in a sensible manner. If we cannot, it's all over
+// handle an optional destination, the messages have already been removed from the inbound queue so any
+// failures are reported but otherwise ignored. While we are waiting after a failure or SOLR is not available
+// we stop taking messages so they queue up and are dropped once we are too far behind. When the inbound
+// channel is closed we add and commit whatever remains and return
+func optionalWorker(dest *destination, inbound <-chan awssqs.Message, stop <-chan struct{}) {
 
-					if len(failedDoc) != 0 {
+	// if we return or panic, give up on whatever is still buffered
+	defer dest.abandon()
 
-						log.Printf("worker %d: WARNING all documents failed due to workerId/doc number %s, attempting to recover", workerId, failedDoc)
+	var message awssqs.Message
 
-						// if we are configured for sub-document delimiters, this might be a sub-document workerId so
-						// attempt to extract the parent document workerId so we can remove it from the block
-						if len(config.SubDocIdDelimiter) != 0 {
-							parentID := strings.Split(failedDoc, config.SubDocIdDelimiter)
-							if parentID[0] != failedDoc {
-								failedDoc = parentID[0]
-								log.Printf("worker %d: WARNING extracted parent workerId (%s) from workerId/doc number, looks like a sub-document failure ", workerId, failedDoc)
-							}
-						}
+	for {
 
-						// iterate through and remove the bad item
-						failedItemRemoved := false
-						for ix, m := range queued {
-							recId, _ := m.GetAttribute(awssqs.AttributeKeyRecordId)
-							if recId == failedDoc {
-								log.Printf("worker %d: WARNING removed workerId/doc number %s, requing the remainder", workerId, failedDoc)
-								queued = append(queued[:ix], queued[ix+1:]...)
-								failedItemRemoved = true
-								break
-							}
-						}
+		arrived := false
+		open := true
+
+		// if we are paused, we only take messages again when it is time to retry or we are shutting down
+		wait := dest.flushWait(waitTimeout)
+		messages := inbound
+		var stopping <-chan struct{}
+		if isStopping(stop) == false {
+			if dest.breaker.isOpen() == true {
+				messages = nil
+				stopping = stop
+				if breakerCheckTime < wait {
+					wait = breakerCheckTime
+				}
+			}
+			if dest.backoff.waiting() == true {
+				messages = nil
+				stopping = stop
+				if dest.backoff.remaining() < wait {
+					wait = dest.backoff.remaining()
+				}
+			}
+		}
 
-						// if we did not remove any items, lets assume that the failed doc is a document *number* instead of a document ID.
-						// remove that one from the list. When we are handling a ErrAllDocumentAdd error, the failed document number
-						// should *always* be 1 (the first document).
+		// process a message or wait...
+		select {
+		case message, open = <-messages:
+			arrived = open
 
-						if failedItemRemoved == false {
+		case <-stopping:
 
-							if failedDoc == "1" {
-								log.Printf("worker %d: WARNING removed first doc in list, requing the remainder", workerId)
-								queued = queued[1:]
-							} else {
-								log.Printf("worker %d: ERROR cannot locate workerId/doc number %s in our list, abandoning all buffered items", workerId, failedDoc)
-								// clear the queue
-								queued = queued[:0]
-							}
-						}
-					} else {
-						log.Printf("worker %d: ERROR cannot determine workerId/doc number from the reported failure, abandoning all buffered items", workerId)
-						// clear the queue
-						queued = queued[:0]
-					}
+		case <-time.After(wait):
+		}
 
-				default:
-					fatalIfError(err)
-				}
+		// we have an inbound message to process
+		if arrived == true {
+			err := dest.buffer(message)
+			if err != nil {
+				log.Printf("worker %d: ERROR optional destination %s buffer failed (%s)", dest.workerId, dest.name, err.Error())
+			}
+		}
 
-				// we have processed all the queued items, break out of the loop
-				if len(queued) == 0 {
-					break
-				}
+		// check to see if it is time to 'add' these to SOLR, unless we are waiting after a failure or SOLR is
+		// not available
+		paused := dest.backoff.waiting() == true || dest.breaker.isOpen() == true
+		if open == false || (paused == false && dest.solr.IsTimeToAdd() == true) {
+			result, err := dest.flush()
+			for _, r := range result.rejected {
+				log.Printf("worker %d: ERROR optional destination %s rejected id/doc number %s (%s)", dest.workerId, dest.name, r.rejection.FailedDoc, r.rejection.Reason)
+			}
+			if len(result.abandoned) != 0 {
+				log.Printf("worker %d: ERROR optional destination %s abandoned %d documents", dest.workerId, dest.name, len(result.abandoned))
+			}
+			// the documents remain buffered, wait a while before trying again
+			if err != nil {
+				dest.failed("add", err)
+			} else {
+				dest.backoff.succeeded()
+			}
+		}
 
-				// otherwise, re-buffer any that need to be reprocessed and try again
-				for _, m := range queued {
-					// get the message identifier
-					id, found := m.GetAttribute(awssqs.AttributeKeyRecordId)
-					if found == false {
-						id = "unknown"
-						log.Printf("WARNING: cannot locate document id, using default")
-					}
-
-					// buffer it to SOLR
-					err = solr.BufferDoc(id, m.Payload)
-					fatalIfError(err)
-				}
+		// we are shutting down, commit and we are done
+		if open == false {
+			err := dest.solr.ForceCommit()
+			if err != nil {
+				log.Printf("worker %d: ERROR optional destination %s final commit failed (%s)", dest.workerId, dest.name, err.Error())
 			}
+			return
 		}
 
 		// is it time to send a commit to SOLR
-		if solr.IsTimeToCommit() == true {
-			err = solr.ForceCommit()
-			fatalIfError(err)
+		if paused == false {
+			err := dest.commitIfTime()
+			if err != nil {
+				dest.failed("commit", err)
+			}
+
+			// and check SOLR is still there
+			dest.pingIfTime()
 		}
 	}
 }
 
-func batchDelete(workerId int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []awssqs.Message) error {
+// have we been told to stop
+func isStopping(stop <-chan struct{}) bool {
 
-	// ensure there is work to do
-	count := uint(len(messages))
-	if count == 0 {
-		return nil
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
 	}
+}
 
-	//log.Printf( "worker %d: About to delete block of %d", workerId, count )
-
-	start := time.Now()
-
-	// we do delete in blocks of awssqs.MAX_SQS_BLOCK_COUNT
-	fullBlocks := count / awssqs.MAX_SQS_BLOCK_COUNT
-	remainder := count % awssqs.MAX_SQS_BLOCK_COUNT
-
-	// go through the inbound messages a 'block' at a time
-	for bix := uint(0); bix < fullBlocks; bix++ {
-
-		// calculate slice range
-		start := bix * awssqs.MAX_SQS_BLOCK_COUNT
-		end := start + awssqs.MAX_SQS_BLOCK_COUNT
+// reject a message before it is sent to any destination
+func rejectUnsent(workerId int, message awssqs.Message, stage string, reason string, cause error, tracker *messageTracker) {
 
-		//log.Printf( "worker %d: Deleting slice [%d:%d]", workerId, start, end )
+	documentsRejected.WithLabelValues(stage, reason).Inc()
+	id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId)
+	rejection := Rejection{Destination: stage, FailedDoc: id, Reason: cause.Error()}
 
-		// and delete them
-		err := blockDelete(workerId, aws, queue, messages[start:end])
-		if err != nil {
-			return err
-		}
+	tracker.track(message, 1)
+	err := tracker.update(flushResult{rejected: []rejectedMessage{{message: message, rejection: rejection}}})
+	if err != nil {
+		log.Printf("worker %d: ERROR update failed (%s)", workerId, err.Error())
 	}
+}
 
-	// handle any remaining
-	if remainder != 0 {
-
-		// calculate slice range
-		start := fullBlocks * awssqs.MAX_SQS_BLOCK_COUNT
-		end := start + remainder
-
-		//log.Printf( "worker %d: Deleting slice [%d:%d]", workerId, start, end )
+// buffer a message to SOLR using the operation it specifies
+func bufferMessage(solr SOLR, config *ServiceConfig, message awssqs.Message) error {
 
-		// and delete them
-		err := blockDelete(workerId, aws, queue, messages[start:end])
-		if err != nil {
-			return err
-		}
+	// get the message identifier
+	id, found := message.GetAttribute(awssqs.AttributeKeyRecordId)
+	if found == false {
+		id = "unknown"
+		log.Printf("WARNING: cannot locate document id, using default")
 	}
 
-	duration := time.Since(start)
-	log.Printf("worker %d: batch delete completed in %0.2f seconds", workerId, duration.Seconds())
+	mode := messageMode(config, message)
+	payload := message.Payload
+	if mode == "add" && len(config.VersionField) != 0 {
+		payload = versionedPayload(config, id, message)
+	}
 
-	return nil
+	return solr.BufferDoc(id, mode, payload)
 }
 
-func blockDelete(workerId int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []awssqs.Message) error {
+// get the SOLR operation for a message. Messages may specify the operation using the operation attribute,
+// otherwise we use the configured mode
+func messageMode(config *ServiceConfig, message awssqs.Message) string {
 
-	// delete the block
-	opStatus, err := aws.BatchMessageDelete(queue, messages)
-	if err != nil {
-		if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
-			return err
-		}
+	operation, found := message.GetAttribute(awssqs.AttributeKeyRecordOperation)
+	if found == false {
+		return config.SolrMode
 	}
 
-	// did we fail
-	if err == awssqs.ErrOneOrMoreOperationsUnsuccessful {
-		for ix, op := range opStatus {
-			if op == false {
-				log.Printf("worker %d: ERROR message %d failed to delete", workerId, ix)
-			}
-		}
+	switch operation {
+	case awssqs.AttributeValueRecordOperationUpdate, "add":
+		return "add"
+	case awssqs.AttributeValueRecordOperationDelete:
+		return "delete"
 	}
 
-	return nil
+	log.Printf("WARNING: unknown message operation [%s], using default", operation)
+	return config.SolrMode
 }
 
 //
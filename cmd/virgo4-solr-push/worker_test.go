@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// a worker configuration with a single required destination talking to a new emulator
+func testWorkerConfig(t *testing.T) (*ServiceConfig, *SolrEmulator) {
+
+	emu := NewSolrEmulator("test", defaultUniqueKey)
+	t.Cleanup(emu.Close)
+
+	config := testConfig()
+	config.SolrUrl = emu.URL()
+	config.HttpRetries = 1
+	config.WorkerQueueSize = 10
+	config.Destinations = []DestinationConfig{{
+		Name:           config.DestinationName,
+		Required:       true,
+		SolrUrl:        config.SolrUrl,
+		SolrCoreName:   config.SolrCoreName,
+		SolrTimeout:    config.SolrTimeout,
+		SolrBlockCount: config.SolrBlockCount,
+		SolrBufferSize: config.SolrBufferSize,
+		SolrFlushTime:  config.SolrFlushTime,
+	}}
+	return &config, emu
+}
+
+// the inbound queue holding a message for each id, the id is also the receipt handle
+func testInbound(ids ...string) chan awssqs.Message {
+
+	inbound := make(chan awssqs.Message, len(ids))
+	for _, id := range ids {
+		m := testMessage(id)
+		m.ReceiptHandle = awssqs.ReceiptHandle(id)
+		inbound <- m
+	}
+	return inbound
+}
+
+// run the function, failing if it does not return in time
+func runWithin(t *testing.T, limit time.Duration, run func()) {
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(limit):
+		t.Fatalf("did not return within %s", limit)
+	}
+}
+
+func TestWorkerShutdown(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		script  string
+		updates int // including the commit
+	}{
+		{name: "drains and commits", script: "", updates: 2},
+		{name: "abandons retries", script: "http:503", updates: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config, emu := testWorkerConfig(t)
+			config.HttpRetries = 3
+			config.HttpRetryBase = 60000
+			config.HttpRetryMax = 60000
+			config.HttpRetryStatus = []int{http.StatusServiceUnavailable}
+			if err := emu.Script(test.script); err != nil {
+				t.Fatalf("bad script: %s", err.Error())
+			}
+
+			// we are told to stop with messages still waiting, the failed add is not retried by the request
+			// but the final flush tries again
+			stop := make(chan struct{})
+			close(stop)
+			source := &testSource{}
+			runWithin(t, 10*time.Second, func() {
+				worker(1, config, source, testInbound("a", "b", "c"), stop)
+			})
+
+			if emu.DocCount() != 3 || emu.Commits() != 1 {
+				t.Errorf("expected 3 documents and a commit, got %d and %d", emu.DocCount(), emu.Commits())
+			}
+			if emu.Updates() != test.updates {
+				t.Errorf("expected %d update requests, got %d", test.updates, emu.Updates())
+			}
+			acknowledged := append([]string{}, source.acknowledged...)
+			sort.Strings(acknowledged)
+			if reflect.DeepEqual(acknowledged, []string{"a", "b", "c"}) == false {
+				t.Errorf("expected every message to be acknowledged, got %v", acknowledged)
+			}
+		})
+	}
+}
+
+// a document processor that panics when it sees the specified id
+type panicProcessor struct {
+	id string
+}
+
+func (p *panicProcessor) Name() string {
+	return "panic"
+}
+
+func (p *panicProcessor) Process(doc *Document, message awssqs.Message) error {
+	if id, _ := message.GetAttribute(awssqs.AttributeKeyRecordId); id == p.id {
+		panic("test panic")
+	}
+	return nil
+}
+
+func TestWorkerPanicReleasesBudget(t *testing.T) {
+
+	config, emu := testWorkerConfig(t)
+	config.InFlightBatches = 1
+	config.Destinations[0].SolrBlockCount = 2
+
+	// the first batch fails and is retained by its lane, the next is buffered when the worker panics
+	_ = emu.Script("http:500")
+	documentProcessors = []DocumentProcessor{&panicProcessor{id: "d"}}
+	t.Cleanup(func() { documentProcessors = documentProcessors[:0] })
+
+	before := bufferBudget.used
+	stop := make(chan struct{})
+	defer close(stop)
+	runWithin(t, 10*time.Second, func() {
+		if runRecovered(1, "worker", func() { worker(1, config, &testSource{}, testInbound("a", "b", "c", "d"), stop) }) == true {
+			t.Errorf("expected the worker to panic")
+		}
+	})
+
+	if bufferBudget.used != before {
+		t.Errorf("expected the buffers to be released, %d bytes are still reserved", bufferBudget.used-before)
+	}
+}
+
+//
+// end of file
+//
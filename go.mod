@@ -6,16 +6,27 @@ toolchain go1.24.4
 
 require (
 	github.com/antchfx/xmlquery v1.5.0
+	github.com/prometheus/client_golang v1.20.5
 	github.com/uvalib/virgo4-sqs-sdk/awssqs v0.0.0-20240403123433-2102b063dbb8
 )
 
 require (
 	github.com/antchfx/xpath v1.3.5 // indirect
 	github.com/aws/aws-sdk-go v1.55.8 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/golang/groupcache v0.0.0-20241129210726-2c02b8208cf8 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	github.com/uvalib/uva-aws-s3-sdk/uva-s3 v0.0.0-20240202155653-277e11cf83e3 // indirect
 	golang.org/x/net v0.48.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )